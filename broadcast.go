@@ -0,0 +1,105 @@
+package junipero
+
+import "sync"
+
+// BroadcastReport 是一次廣播的結果。由於訊息是非同步地被寫入至客戶端，
+// 報告中的送達僅表示訊息已經成功放入客戶端的寫入佇列，並不代表客戶端已經接收到訊息。
+// 之後在寫入迴圈中發生的寫入錯誤不會反映在報告中，而是會直接中斷該客戶端的連線。
+type BroadcastReport struct {
+	// Delivered 是訊息成功放入寫入佇列的客戶端數量，這並不保證訊息已經寫入至連線。
+	Delivered int
+	// Dropped 是因寫入佇列已滿而拋棄了此訊息的客戶端數量。
+	Dropped int
+	// Failed 是因其他原因（如：階段已經關閉）而無法寫入的客戶端與其錯誤。
+	Failed map[*Session]error
+}
+
+// add 會將訊息寫入至指定客戶端的結果記錄於報告中，
+// 寫入失敗時如果引擎設置了 `CloseOnBroadcastFailure` 則會中斷該客戶端的連線。
+func (r *BroadcastReport) add(s *Session, err error) {
+	switch err {
+	case nil:
+		r.Delivered++
+		return
+	case ErrSendQueueFull, ErrWriteTimedOut:
+		r.Dropped++
+	default:
+		if r.Failed == nil {
+			r.Failed = make(map[*Session]error)
+		}
+		r.Failed[s] = err
+	}
+	if s.engine.config.CloseOnBroadcastFailure {
+		s.CloseWithStatus(ClosePolicyViolation, "broadcast failed")
+	}
+}
+
+// merge 會將另一份報告的結果合併至此報告中。
+func (r *BroadcastReport) merge(v *BroadcastReport) {
+	r.Delivered += v.Delivered
+	r.Dropped += v.Dropped
+	for k, err := range v.Failed {
+		if r.Failed == nil {
+			r.Failed = make(map[*Session]error)
+		}
+		r.Failed[k] = err
+	}
+}
+
+// filter 會回傳經篩選的客戶端，這會重複使用傳入的切片。
+func filter(sessions []*Session, fn func(*Session) bool) []*Session {
+	n := 0
+	for _, v := range sessions {
+		if fn(v) {
+			sessions[n] = v
+			n++
+		}
+	}
+	return sessions[:n]
+}
+
+// fanOut 會以指定的寫入函式將訊息寫入至所有客戶端並回傳其報告。客戶端數量超過 `BroadcastBatchSize` 時，
+// 客戶端會被分批交由最多 `BroadcastWorkers` 個 goroutine 同時寫入，每個客戶端仍然只會被寫入一次。
+func (e *Engine) fanOut(sessions []*Session, m *message, write func(*Session, *message) error) *BroadcastReport {
+	r := &BroadcastReport{}
+	size, workers := e.config.BroadcastBatchSize, e.config.BroadcastWorkers
+	if workers <= 1 || len(sessions) <= size {
+		for _, v := range sessions {
+			r.add(v, write(v, m))
+		}
+		return r
+	}
+	if n := (len(sessions) + size - 1) / size; n < workers {
+		workers = n
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	batches := make(chan []*Session)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			part := &BroadcastReport{}
+			for batch := range batches {
+				for _, v := range batch {
+					part.add(v, write(v, m))
+				}
+			}
+			mu.Lock()
+			r.merge(part)
+			mu.Unlock()
+		}()
+	}
+	for i := 0; i < len(sessions); i += size {
+		end := i + size
+		if end > len(sessions) {
+			end = len(sessions)
+		}
+		batches <- sessions[i:end]
+	}
+	close(batches)
+	wg.Wait()
+	return r
+}
@@ -1,155 +1,409 @@
 package junipero
 
-// Channel 呈現了一個頻道。
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Channel 呈現了一個頻道，可以安全地被多個 goroutine 同時使用。
 type Channel struct {
+	// subscribers 是訂閱者數量，
+	// 為了在 32 位元平台上能夠以 atomic 存取，這必須是第一個欄位。
+	subscribers int64
 	// name 是這個頻道的名稱。
 	name string
-	// sessions 是所有訂閱此頻道的階段客戶端連線。
-	Sessions map[int]*Session
-	// isClosed 表示此頻道是否已經關閉了。
-	isClosed bool
 	// config 是頻道設置。
 	config *ChannelConfig
+	// engine 是此頻道所屬的引擎。
+	engine *Engine
+
+	// sessions 是所有訂閱此頻道的階段客戶端連線，以階段編號分片存放。
+	sessions sessionMap
+
+	// mu 保護了下列的狀態欄位，訂閱時會讀取鎖定此鎖，關閉頻道時則會完全鎖定。
+	mu sync.RWMutex
+	// isClosed 表示此頻道是否已經關閉了。
+	isClosed bool
+
+	// idleMu 保護了閒置計時器。
+	idleMu sync.Mutex
+	// idle 會在頻道沒有任何訂閱者超過 `IdleTTL` 時關閉頻道。
+	idle *time.Timer
 }
 
 // ChannelConfig 是頻道設置。
 type ChannelConfig struct {
+	// OverflowPolicy 是廣播時客戶端寫入佇列已滿的處理方式，
+	// 設置為 `OverflowDefault` 則會沿用引擎設置。
+	OverflowPolicy OverflowPolicy
+	// OverflowTimeout 是 `OverflowBlock` 策略等待佇列空間的時間，
+	// 設置為 `0` 則會沿用引擎設置，引擎也沒有設置等待時間時則會一直等到佇列有空間或是階段關閉為止。
+	OverflowTimeout time.Duration
+	// MaxSubscribers 是頻道的訂閱者數量上限，額滿時訂閱會回傳 `ErrChannelFull`，設置為 `0` 則不限制。
+	MaxSubscribers int
+	// AutoDelete 表示是否要在最後一個訂閱者離開時自動關閉並刪除頻道。
+	AutoDelete bool
+	// IdleTTL 是頻道沒有任何訂閱者多久後會自動關閉並刪除，設置為 `0` 則不會因閒置而刪除。
+	IdleTTL time.Duration
+	// OnSubscribe 會在客戶端訂閱此頻道後被呼叫。
+	OnSubscribe func(*Channel, *Session)
+	// OnUnsubscribe 會在客戶端取消訂閱此頻道後被呼叫，這包含了客戶端中斷連線與頻道關閉。
+	OnUnsubscribe func(*Channel, *Session)
+	// OnClose 會在頻道關閉並取消所有客戶端的訂閱後被呼叫。
+	OnClose func(*Channel)
 }
 
-// NewChannel 會建立一個新的可訂閱頻道。
-func (e *Engine) NewChannel(name string, conf *ChannelConfig) *Channel {
-	ch := &Channel{
-		name:   name,
-		config: conf,
+// NewChannel 會建立一個新的可訂閱頻道，如果已經有同名的頻道則會回傳 `ErrChannelExists`。
+func (e *Engine) NewChannel(name string, conf *ChannelConfig) (*Channel, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.channels[name]; ok {
+		return nil, ErrChannelExists
 	}
+	return e.newChannel(name, conf), nil
+}
+
+// newChannel 會建立並登記一個新的頻道，呼叫時必須持有引擎的鎖。
+func (e *Engine) newChannel(name string, conf *ChannelConfig) *Channel {
+	ch := &Channel{name: name, config: conf, engine: e}
 	e.channels[name] = ch
+	if conf != nil && conf.IdleTTL > 0 {
+		ch.startIdle()
+	}
 	return ch
 }
 
-// Broadcast 能夠將文字訊息廣播給頻道中的所有客戶端。
-func (c *Channel) Broadcast(msg string) error {
-	if c.isClosed {
-		return ErrChannelClosed
+// LoadOrNewChannel 會取得指定名稱的頻道，如果頻道不存在則會以指定的設置建立一個新的頻道。
+// 回傳的布林值表示頻道是否早已存在，早已存在的頻道並不會套用傳入的設置。
+func (e *Engine) LoadOrNewChannel(name string, conf *ChannelConfig) (*Channel, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ch, ok := e.channels[name]; ok {
+		return ch, true
 	}
-	for _, v := range c.Sessions {
-		v.Write(msg)
+	return e.newChannel(name, conf), false
+}
+
+// Channel 會取得指定名稱的頻道。
+func (e *Engine) Channel(name string) (*Channel, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ch, ok := e.channels[name]
+	return ch, ok
+}
+
+// Channels 會回傳一份目前所有頻道的複本。
+func (e *Engine) Channels() map[string]*Channel {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	channels := make(map[string]*Channel, len(e.channels))
+	for k, v := range e.channels {
+		channels[k] = v
 	}
-	return nil
+	return channels
 }
 
-// BroadcastFilter 能夠將文字訊息廣播給頻道中被篩選客戶端。
-func (c *Channel) BroadcastFilter(msg string, fn func(*Session) bool) error {
+// DeleteChannel 會關閉指定名稱的頻道並將其從引擎中移除，頻道不存在時則會回傳 `ErrChannelNotFound`。
+func (e *Engine) DeleteChannel(name string) error {
+	ch, ok := e.Channel(name)
+	if !ok {
+		return ErrChannelNotFound
+	}
+	return ch.Close()
+}
+
+// Name 會回傳頻道的名稱。
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// snapshot 會在鎖定的情況下複製一份目前所有的訂閱者，
+// 如果頻道已經關閉則會回傳 `ErrChannelClosed`。
+func (c *Channel) snapshot() ([]*Session, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if c.isClosed {
-		return ErrChannelClosed
+		return nil, ErrChannelClosed
 	}
-	for _, v := range c.Sessions {
-		if fn(v) {
-			v.Write(msg)
+	return c.sessions.snapshot(), nil
+}
+
+// write 會依照頻道的溢出策略將訊息寫入到指定的客戶端，未設置的選項會沿用引擎設置。
+func (c *Channel) write(s *Session, m *message) error {
+	policy, timeout := s.engine.config.OverflowPolicy, s.engine.config.OverflowTimeout
+	if c.config != nil {
+		if c.config.OverflowPolicy != OverflowDefault {
+			policy = c.config.OverflowPolicy
+		}
+		if c.config.OverflowTimeout != 0 {
+			timeout = c.config.OverflowTimeout
 		}
 	}
-	return nil
+	return s.enqueueWith(m, policy, timeout)
+}
+
+// Broadcast 能夠將文字訊息廣播給頻道中的所有客戶端，所有廣播的訊息只會被編碼成訊框一次並由所有客戶端共用。
+func (c *Channel) Broadcast(msg string) error {
+	_, err := c.BroadcastWithReport(msg)
+	return err
+}
+
+// BroadcastWithReport 與 `Broadcast` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastWithReport(msg string) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	m := newPreparedMessage(TextMessage, []byte(msg))
+	return c.engine.fanOut(sessions, m, c.write), nil
+}
+
+// BroadcastFilter 能夠將文字訊息廣播給頻道中被篩選客戶端。
+func (c *Channel) BroadcastFilter(msg string, fn func(*Session) bool) error {
+	_, err := c.BroadcastFilterWithReport(msg, fn)
+	return err
+}
+
+// BroadcastFilterWithReport 與 `BroadcastFilter` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastFilterWithReport(msg string, fn func(*Session) bool) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	m := newPreparedMessage(TextMessage, []byte(msg))
+	return c.engine.fanOut(filter(sessions, fn), m, c.write), nil
 }
 
 // BroadcastOthers 能夠將文字訊息廣播給頻道中指定以外的所有客戶端。
 func (c *Channel) BroadcastOthers(msg string, s *Session) error {
-	if c.isClosed {
-		return ErrChannelClosed
-	}
-	for _, v := range c.Sessions {
-		if v != s {
-			v.Write(msg)
-		}
+	_, err := c.BroadcastOthersWithReport(msg, s)
+	return err
+}
+
+// BroadcastOthersWithReport 與 `BroadcastOthers` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastOthersWithReport(msg string, s *Session) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	m := newPreparedMessage(TextMessage, []byte(msg))
+	return c.engine.fanOut(filter(sessions, func(v *Session) bool {
+		return v != s
+	}), m, c.write), nil
 }
 
 // BroadcastBinary 能夠將二進制訊息廣播給頻道中的所有客戶端。
+// 訊息會先被複製，因此呼叫者在回傳後可以繼續使用 `msg`。
 func (c *Channel) BroadcastBinary(msg []byte) error {
-	if c.isClosed {
-		return ErrChannelClosed
-	}
-	for _, v := range c.Sessions {
-		v.WriteBinary(msg)
+	_, err := c.BroadcastBinaryWithReport(msg)
+	return err
+}
+
+// BroadcastBinaryWithReport 與 `BroadcastBinary` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastBinaryWithReport(msg []byte) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	m := newPreparedMessage(BinaryMessage, cloneBytes(msg))
+	return c.engine.fanOut(sessions, m, c.write), nil
 }
 
 // BroadcastBinaryFilter 能夠將二進制訊息廣播給頻道中被篩選客戶端。
 func (c *Channel) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
-	if c.isClosed {
-		return ErrChannelClosed
-	}
-	for _, v := range c.Sessions {
-		if fn(v) {
-			v.WriteBinary(msg)
-		}
+	_, err := c.BroadcastBinaryFilterWithReport(msg, fn)
+	return err
+}
+
+// BroadcastBinaryFilterWithReport 與 `BroadcastBinaryFilter` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastBinaryFilterWithReport(msg []byte, fn func(*Session) bool) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	m := newPreparedMessage(BinaryMessage, cloneBytes(msg))
+	return c.engine.fanOut(filter(sessions, fn), m, c.write), nil
 }
 
 // BroadcastBinaryOthers 能夠將二進制訊息廣播給頻道中指定以外的所有客戶端。
 func (c *Channel) BroadcastBinaryOthers(msg []byte, s *Session) error {
+	_, err := c.BroadcastBinaryOthersWithReport(msg, s)
+	return err
+}
+
+// BroadcastBinaryOthersWithReport 與 `BroadcastBinaryOthers` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastBinaryOthersWithReport(msg []byte, s *Session) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	m := newPreparedMessage(BinaryMessage, cloneBytes(msg))
+	return c.engine.fanOut(filter(sessions, func(v *Session) bool {
+		return v != s
+	}), m, c.write), nil
+}
+
+// close 會將頻道標記為已關閉、從引擎中移除並取消所有客戶端的訂閱，
+// 回傳的是在關閉之前仍訂閱此頻道的客戶端。
+func (c *Channel) close() ([]*Session, error) {
+	c.mu.Lock()
 	if c.isClosed {
-		return ErrChannelClosed
+		c.mu.Unlock()
+		return nil, ErrChannelClosed
+	}
+	c.isClosed = true
+	sessions := c.sessions.snapshot()
+	c.mu.Unlock()
+	c.finish(sessions)
+	return sessions, nil
+}
+
+// finish 會將已關閉的頻道從引擎中移除、取消指定客戶端的訂閱，並呼叫 `OnClose`。
+func (c *Channel) finish(sessions []*Session) {
+	c.stopIdle()
+	c.engine.mu.Lock()
+	if c.engine.channels[c.name] == c {
+		delete(c.engine.channels, c.name)
+	}
+	c.engine.mu.Unlock()
+	for _, v := range sessions {
+		v.unsubscribe(c)
 	}
-	for _, v := range c.Sessions {
-		if v != s {
-			v.WriteBinary(msg)
+	if c.config != nil && c.config.OnClose != nil {
+		c.config.OnClose(c)
+	}
+}
+
+// reserve 會在頻道尚未額滿時增加一個訂閱者，頻道由空轉為有訂閱者時會停止閒置計時器。
+// 這必須在讀取鎖定頻道時呼叫，以免與 `closeIdle` 同時發生。
+func (c *Channel) reserve() bool {
+	var max int64
+	if c.config != nil {
+		max = int64(c.config.MaxSubscribers)
+	}
+	for {
+		n := atomic.LoadInt64(&c.subscribers)
+		if max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.subscribers, n, n+1) {
+			if n == 0 {
+				c.stopIdle()
+			}
+			return true
 		}
 	}
-	return nil
 }
 
-// Close 會關閉頻道並將其訂閱的客戶端全部取消訂閱。
-func (c *Channel) Close() error {
-	if c.isClosed {
-		return ErrChannelClosed
+// empty 會在最後一個訂閱者離開時依照設置刪除頻道或是開始閒置計時。
+func (c *Channel) empty() {
+	if c.config == nil || c.IsClosed() {
+		return
 	}
-	c.isClosed = true
-	for _, v := range c.Sessions {
-		v.Unsubscribe(c.name)
+	if c.config.AutoDelete {
+		c.closeIdle()
+	} else if c.config.IdleTTL > 0 {
+		c.startIdle()
+	}
+}
+
+// startIdle 會重新開始閒置計時器。
+func (c *Channel) startIdle() {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	c.idle = time.AfterFunc(c.config.IdleTTL, c.closeIdle)
+}
+
+// stopIdle 會停止閒置計時器。
+func (c *Channel) stopIdle() {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
 	}
-	return nil
+}
+
+// closeIdle 會在頻道仍然沒有任何訂閱者時關閉頻道，訂閱者是在讀取鎖定頻道時增加的，
+// 因此在完全鎖定頻道時確認沒有訂閱者便能確保關閉時不會有訂閱者同時加入。
+func (c *Channel) closeIdle() {
+	c.mu.Lock()
+	if c.isClosed || atomic.LoadInt64(&c.subscribers) != 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.isClosed = true
+	c.mu.Unlock()
+	c.finish(nil)
+}
+
+// Close 會關閉頻道並將其訂閱的客戶端全部取消訂閱，關閉後的頻道會從引擎中移除，其名稱能夠再被用來建立新的頻道。
+func (c *Channel) Close() error {
+	_, err := c.close()
+	return err
 }
 
 // CloseWithMsg 會關閉頻道並取消所有客戶端訂閱，但在那之前會先發送一則文字訊息。
 func (c *Channel) CloseWithMsg(msg string) error {
-	if c.isClosed {
-		return ErrChannelClosed
+	sessions, err := c.close()
+	if err != nil {
+		return err
 	}
-	c.isClosed = true
-	for _, v := range c.Sessions {
-		v.Unsubscribe(c.name)
-		v.Write(msg)
+	m := newPreparedMessage(TextMessage, []byte(msg))
+	for _, v := range sessions {
+		c.write(v, m)
 	}
 	return nil
 }
 
 // CloseWithBinary 會關閉頻道並取消所有客戶端訂閱，但在那之前會先發送一則二進制訊息。
 func (c *Channel) CloseWithBinary(msg []byte) error {
-	if c.isClosed {
-		return ErrChannelClosed
+	sessions, err := c.close()
+	if err != nil {
+		return err
 	}
-	c.isClosed = true
-	for _, v := range c.Sessions {
-		v.Unsubscribe(c.name)
-		v.WriteBinary(msg)
+	m := newPreparedMessage(BinaryMessage, cloneBytes(msg))
+	for _, v := range sessions {
+		c.write(v, m)
+	}
+	return nil
+}
+
+// CloseWithStatus 會關閉頻道，並以指定的狀態代號與原因中斷所有訂閱此頻道的客戶端連線。
+func (c *Channel) CloseWithStatus(status CloseStatus, reason string) error {
+	sessions, err := c.close()
+	if err != nil {
+		return err
+	}
+	for _, v := range sessions {
+		v.CloseWithStatus(status, reason)
 	}
 	return nil
 }
 
 // IsClosed 會回傳表示這個頻道是否已經關閉。
 func (c *Channel) IsClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.isClosed
 }
 
 // Contains 會表示指定的客戶端是否有訂閱此頻道。
 func (c *Channel) Contains(s *Session) bool {
-	_, ok := c.Sessions[s.id]
+	_, ok := c.sessions.load(s.id)
 	return ok
 }
 
+// Sessions 會回傳一份目前訂閱此頻道的客戶端複本。
+func (c *Channel) Sessions() map[string]*Session {
+	return c.sessions.copy()
+}
+
 // Len 會表示頻道的總訂閱客戶端數量。
 func (c *Channel) Len() int {
-	return len(c.Sessions)
+	return c.sessions.len()
 }
@@ -2,19 +2,36 @@ package junipero
 
 import (
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Client 呈現了一個 WebSocket 客戶端。
+// Client 呈現了一個 WebSocket 客戶端，可以安全地被多個 goroutine 同時使用。
 type Client struct {
 	// Config 是客戶端設置。
 	config *ClientConfig
 	// conn 是底層的 WebSocket 連線。
 	conn *websocket.Conn
+	// codec 是此客戶端依照協商後的子協定所選擇的編碼方式。
+	codec Codec
+	// readMu 確保同一時間只有一個 goroutine 能讀取連線。
+	readMu sync.Mutex
+	// writeMu 確保同一時間只有一個 goroutine 能寫入連線。
+	writeMu sync.Mutex
+
+	// calls 是等待伺服端回應的遠端呼叫。
+	calls pending
+	// done 會在客戶端關閉時被關閉，用以結束等待中的遠端呼叫。
+	done chan struct{}
+
+	// mu 保護了下列的狀態與方法處理函式欄位。
+	mu sync.RWMutex
 	// isClosed 會表示此客戶端是否已經關閉連線了。
 	isClosed bool
+	// methods 是能夠被伺服端遠端呼叫的方法。
+	methods map[string]ClientMethodHandler
 }
 
 // ClientConfig 是客戶端設置。
@@ -25,6 +42,11 @@ type ClientConfig struct {
 	Header http.Header
 	// WriteWait 是每次訊息寫入時的逾時時間。
 	WriteWait time.Duration
+	// Codec 是 `WriteValue` 與 `ReadValue` 預設的編碼方式，設置為 `nil` 則會使用 `JSONCodec`。
+	Codec Codec
+	// Codecs 是以子協定名稱對應的編碼方式，連線時會依照名稱排序向伺服端提出這些子協定，
+	// 伺服端選擇了其中的子協定時便會使用對應的編碼方式。
+	Codecs map[string]Codec
 }
 
 // NewClient 會建立客戶端並連線到指定的 WebSocket 伺服端。
@@ -32,13 +54,19 @@ func NewClient(conf *ClientConfig) (*Client, *http.Response, error) {
 	if conf.WriteWait == 0 {
 		conf.WriteWait = time.Second * 30
 	}
-	conn, resp, err := websocket.DefaultDialer.Dial(conf.Address, conf.Header)
+	dialer := *websocket.DefaultDialer
+	if len(conf.Codecs) != 0 {
+		dialer.Subprotocols = subprotocols(conf.Codecs)
+	}
+	conn, resp, err := dialer.Dial(conf.Address, conf.Header)
 	if err != nil {
 		return nil, resp, err
 	}
 	client := &Client{
 		config: conf,
 		conn:   conn,
+		codec:  selectCodec(conn.Subprotocol(), conf.Codecs, conf.Codec),
+		done:   make(chan struct{}),
 	}
 	return client, resp, nil
 }
@@ -46,7 +74,7 @@ func NewClient(conf *ClientConfig) (*Client, *http.Response, error) {
 // ReadMessage 會阻塞程式直到有訊息為止，接收到的訊息會 `string` 字串標準訊息。
 // 任何系統訊息像是 Ping-Pong 與 Close 都不會出現在這裡。
 func (c *Client) Read() (string, error) {
-	if c.isClosed {
+	if c.IsClosed() {
 		return "", ErrConnectionClosed
 	}
 	for {
@@ -64,7 +92,7 @@ func (c *Client) Read() (string, error) {
 // ReadBinary 會阻塞程式直到有訊息為止，接收到的訊息會是 `[]byte` 二進制標準訊息。
 // 任何系統訊息像是 Ping-Pong 與 Close 都不會出現在這裡。
 func (c *Client) ReadBinary() ([]byte, error) {
-	if c.isClosed {
+	if c.IsClosed() {
 		return []byte(``), ErrConnectionClosed
 	}
 	for {
@@ -81,63 +109,75 @@ func (c *Client) ReadBinary() ([]byte, error) {
 
 // ReadAll 會阻塞程式直到有訊息為止，
 // 這會接收到所有訊息像是 Ping-Pong 與 Close 或標準的文字甚至二進制訊息。
+// 遠端呼叫與其回應會在這裡被處理，並不會被回傳。
+// 讀取失敗時表示連線已經中斷，客戶端會被關閉，等待回應中的遠端呼叫也會以 `ErrConnectionClosed` 結束。
 func (c *Client) ReadAll() (MessageType, []byte, error) {
-	if c.isClosed {
+	if c.IsClosed() {
 		return 0, []byte(``), ErrConnectionClosed
 	}
-	typ, msg, err := c.conn.ReadMessage()
-	if err != nil {
-		return MessageType(typ), msg, err
+	for {
+		c.readMu.Lock()
+		typ, msg, err := c.conn.ReadMessage()
+		c.readMu.Unlock()
+		if err != nil {
+			c.markClosed()
+			c.conn.Close()
+			return MessageType(typ), msg, err
+		}
+		if MessageType(typ) == TextMessage && c.call(msg) {
+			continue
+		}
+		return MessageType(typ), msg, nil
 	}
-	return MessageType(typ), msg, nil
 }
 
 // Disconnect 會依照正常手續告訴伺服器關閉並結束客戶端連線。
 func (c *Client) Disconnect() error {
-	if c.isClosed {
+	if !c.markClosed() {
 		return ErrConnectionClosed
 	}
-	c.isClosed = true
 	return c.conn.WriteControl(int(CloseMessage), websocket.FormatCloseMessage(int(CloseNormalClosure), ""), time.Now().Add(c.config.WriteWait))
 }
 
 // DisconnectWithMsg 會依照正常手續且帶有文字訊息告訴伺服器關閉並結束客戶端連線。
 func (c *Client) DisconnectWithMsg(msg string) error {
-	if c.isClosed {
+	if !c.markClosed() {
 		return ErrConnectionClosed
 	}
-	c.isClosed = true
 	return c.conn.WriteControl(int(CloseMessage), websocket.FormatCloseMessage(int(CloseNormalClosure), msg), time.Now().Add(c.config.WriteWait))
 }
 
 // Close 會關閉並結束客戶端連線。
 func (c *Client) Close() error {
-	if c.isClosed {
+	if !c.markClosed() {
 		return ErrConnectionClosed
 	}
-	c.isClosed = true
 	return c.conn.Close()
 }
 
 // Write 能夠傳送文字訊息至伺服端。
 func (c *Client) Write(msg string) error {
-	if c.isClosed {
+	if c.IsClosed() {
 		return ErrConnectionClosed
 	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return c.conn.WriteMessage(int(TextMessage), []byte(msg))
 }
 
 // WriteBinary 能夠傳送二進制訊息至伺服端。
 func (c *Client) WriteBinary(msg []byte) error {
-	if c.isClosed {
+	if c.IsClosed() {
 		return ErrConnectionClosed
 	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return c.conn.WriteMessage(int(BinaryMessage), msg)
 }
 
 // Ping 能夠發送 Ping 至伺服端並且等待 Pong 回應，
 func (c *Client) Ping() error {
-	if c.isClosed {
+	if c.IsClosed() {
 		return ErrConnectionClosed
 	}
 	return c.conn.WriteControl(int(PingMessage), []byte(``), time.Now().Add(c.config.WriteWait))
@@ -145,13 +185,27 @@ func (c *Client) Ping() error {
 
 // Pong 能夠主動不等待 Ping 的情況下直接回應伺服端。
 func (c *Client) Pong() error {
-	if c.isClosed {
+	if c.IsClosed() {
 		return ErrConnectionClosed
 	}
 	return c.conn.WriteControl(int(PongMessage), []byte(``), time.Now().Add(c.config.WriteWait))
 }
 
+// markClosed 會將客戶端標記為已關閉，如果客戶端早已關閉則回傳 `false`。
+func (c *Client) markClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return false
+	}
+	c.isClosed = true
+	close(c.done)
+	return true
+}
+
 // IsClosed 會表示該連線是否已經關閉並結束了。
 func (c *Client) IsClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.isClosed
 }
@@ -0,0 +1,184 @@
+package junipero
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Codec 是結構化資料的編碼方式，用以在 `WriteValue` 與 `ReadValue` 時編碼與解碼資料，
+// MessagePack 與 CBOR 位於 `codecs` 套件中，其他的格式（如：Protocol Buffers）可以自行實作此介面。
+// 廣播時會以編碼方式區分並快取編碼結果，無法比較的型態則會替每個客戶端各自編碼。
+type Codec interface {
+	// Marshal 會編碼指定的資料。
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal 會將資料解碼至指定的指標。
+	Unmarshal(data []byte, v interface{}) error
+	// MessageType 是編碼後的資料要以何種訊息種類傳送。
+	MessageType() MessageType
+}
+
+var (
+	// JSONCodec 會以 JSON 編碼資料，並以文字訊息傳送。
+	JSONCodec Codec = jsonCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) MessageType() MessageType                   { return TextMessage }
+
+// selectCodec 會依照協商後的子協定選擇編碼方式，沒有對應的子協定時則使用預設的編碼方式。
+func selectCodec(subprotocol string, codecs map[string]Codec, codec Codec) Codec {
+	if v, ok := codecs[subprotocol]; ok && subprotocol != "" {
+		return v
+	}
+	if codec == nil {
+		return JSONCodec
+	}
+	return codec
+}
+
+// subprotocols 會依照名稱排序回傳所有編碼方式的子協定名稱。
+func subprotocols(codecs map[string]Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for k := range codecs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encoder 會將同一個資料依照不同的編碼方式各自只編碼一次，用以在廣播時避免重複編碼。
+type encoder struct {
+	v    interface{}
+	msgs map[Codec]*message
+	// sessions 是使用了無法比較的編碼方式的客戶端各自編碼後的訊息，這些編碼方式無法作為快取的鍵。
+	sessions map[*Session]*message
+}
+
+// newEncoder 會以指定客戶端們的編碼方式預先編碼資料，編碼完成後快取便只會被讀取，能夠被多個 goroutine 同時使用。
+func newEncoder(v interface{}, sessions []*Session) (*encoder, error) {
+	enc := &encoder{v: v, msgs: make(map[Codec]*message)}
+	for _, s := range sessions {
+		if reflect.TypeOf(s.codec).Comparable() {
+			if _, err := enc.encode(s.codec); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := s.codec.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if enc.sessions == nil {
+			enc.sessions = make(map[*Session]*message)
+		}
+		enc.sessions[s] = &message{typ: s.codec.MessageType(), data: data}
+	}
+	return enc, nil
+}
+
+// encode 會回傳以指定編碼方式編碼後的訊息，已經編碼過的則會直接回傳快取。
+func (e *encoder) encode(c Codec) (*message, error) {
+	if m, ok := e.msgs[c]; ok {
+		return m, nil
+	}
+	data, err := c.Marshal(e.v)
+	if err != nil {
+		return nil, err
+	}
+	m := newPreparedMessage(c.MessageType(), data)
+	e.msgs[c] = m
+	return m, nil
+}
+
+// message 會回傳要傳送給指定客戶端的已編碼訊息。
+func (e *encoder) message(s *Session) *message {
+	if m, ok := e.sessions[s]; ok {
+		return m
+	}
+	return e.msgs[s.codec]
+}
+
+// Codec 會回傳此階段所使用的編碼方式，這會依照協商後的子協定而定。
+func (s *Session) Codec() Codec {
+	return s.codec
+}
+
+// WriteValue 會以此階段的編碼方式編碼資料並傳送給客戶端。
+func (s *Session) WriteValue(v interface{}) error {
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.enqueue(&message{typ: s.codec.MessageType(), data: data})
+}
+
+// BroadcastValue 會將資料以各個客戶端的編碼方式編碼後傳送給所有客戶端，每種編碼方式只會編碼一次。
+// 編碼失敗時不會傳送給任何客戶端並回傳錯誤。
+func (e *Engine) BroadcastValue(v interface{}) error {
+	_, err := e.BroadcastValueWithReport(v)
+	return err
+}
+
+// BroadcastValueWithReport 與 `BroadcastValue` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastValueWithReport(v interface{}) (*BroadcastReport, error) {
+	sessions := e.snapshot()
+	enc, err := newEncoder(v, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return e.fanOut(sessions, nil, func(s *Session, _ *message) error {
+		return s.enqueue(enc.message(s))
+	}), nil
+}
+
+// BroadcastValue 會將資料以各個客戶端的編碼方式編碼後廣播給頻道中的所有客戶端，每種編碼方式只會編碼一次。
+// 編碼失敗時不會傳送給任何客戶端並回傳錯誤。
+func (c *Channel) BroadcastValue(v interface{}) error {
+	_, err := c.BroadcastValueWithReport(v)
+	return err
+}
+
+// BroadcastValueWithReport 與 `BroadcastValue` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (c *Channel) BroadcastValueWithReport(v interface{}) (*BroadcastReport, error) {
+	sessions, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncoder(v, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return c.engine.fanOut(sessions, nil, func(s *Session, _ *message) error {
+		return c.write(s, enc.message(s))
+	}), nil
+}
+
+// Codec 會回傳此客戶端所使用的編碼方式，這會依照協商後的子協定而定。
+func (c *Client) Codec() Codec {
+	return c.codec
+}
+
+// WriteValue 會以客戶端的編碼方式編碼資料並傳送至伺服端。
+func (c *Client) WriteValue(v interface{}) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if c.codec.MessageType() == BinaryMessage {
+		return c.WriteBinary(data)
+	}
+	return c.Write(string(data))
+}
+
+// ReadValue 會阻塞程式直到有訊息為止，並以客戶端的編碼方式將訊息解碼至指定的指標。
+func (c *Client) ReadValue(v interface{}) error {
+	_, msg, err := c.ReadAll()
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(msg, v)
+}
@@ -0,0 +1,28 @@
+// Package codecs 提供了 junipero 核心以外的結構化資料編碼方式，
+// 如此一來只使用 JSON 的專案便不需要依賴這些格式的套件。
+package codecs
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/teacat/junipero"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	// MessagePack 會以 MessagePack 編碼資料，並以二進制訊息傳送。
+	MessagePack junipero.Codec = msgpackCodec{}
+	// CBOR 會以 CBOR 編碼資料，並以二進制訊息傳送。
+	CBOR junipero.Codec = cborCodec{}
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+func (msgpackCodec) MessageType() junipero.MessageType          { return junipero.BinaryMessage }
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) MessageType() junipero.MessageType          { return junipero.BinaryMessage }
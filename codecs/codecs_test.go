@@ -0,0 +1,28 @@
+package codecs
+
+import (
+	"testing"
+
+	"github.com/teacat/junipero"
+)
+
+func TestCodecs(t *testing.T) {
+	type point struct {
+		X    int    `msgpack:"x" cbor:"x"`
+		Name string `msgpack:"name" cbor:"name"`
+	}
+	expected := point{X: 1, Name: "junipero"}
+	for name, c := range map[string]junipero.Codec{"msgpack": MessagePack, "cbor": CBOR} {
+		data, err := c.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p point
+		if err := c.Unmarshal(data, &p); err != nil || p != expected {
+			t.Fatalf("expected %v from %s, got %v, %v", expected, name, p, err)
+		}
+		if c.MessageType() != junipero.BinaryMessage {
+			t.Fatalf("expected %s to be sent as binary messages", name)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package junipero
+
+import "net/http"
+
+// Handler 是 WebSocket 訊息和相關功能的處理函式。
+//
+// 引擎並不要求處理函式實作此介面的所有函式，
+// 傳入 `NewServer` 的處理函式只需要實作所需要的部分介面（如：`Connecter`、`Messager`），
+// 未實作的事件會被直接忽略。也可以使用 `HandlerFuncs` 以函式欄位來建立處理函式。
+type Handler interface {
+	Closer
+	Connecter
+	Disconnecter
+	Errorer
+	Messager
+	BinaryMessager
+	SentMessager
+	SentBinaryMessager
+	Pinger
+	Ponger
+	Requester
+}
+
+// Closer 會在接收到客戶端的關閉訊息時被呼叫。
+type Closer interface {
+	Close(*Session, CloseStatus, string) error
+}
+
+// Connecter 會在客戶端連線後被呼叫。
+type Connecter interface {
+	Connect(*Session)
+}
+
+// Disconnecter 會在客戶端階段結束時被呼叫，每個階段僅會呼叫一次。
+type Disconnecter interface {
+	Disconnect(*Session)
+}
+
+// Errorer 會在客戶端階段發生錯誤時被呼叫。
+type Errorer interface {
+	Error(*Session, error)
+}
+
+// Messager 會在接收到客戶端的文字訊息時被呼叫。
+type Messager interface {
+	Message(*Session, string)
+}
+
+// BinaryMessager 會在接收到客戶端的二進制訊息時被呼叫。
+type BinaryMessager interface {
+	MessageBinary(*Session, []byte)
+}
+
+// SentMessager 會在文字訊息成功寫入客戶端後被呼叫。
+type SentMessager interface {
+	SentMessage(*Session, string)
+}
+
+// SentBinaryMessager 會在二進制訊息成功寫入客戶端後被呼叫。
+type SentBinaryMessager interface {
+	SentMessageBinary(*Session, []byte)
+}
+
+// Pinger 會在接收到客戶端的 Ping 時被呼叫。
+type Pinger interface {
+	Ping(*Session)
+}
+
+// Ponger 會在接收到客戶端的 Pong 時被呼叫。
+type Ponger interface {
+	Pong(*Session)
+}
+
+// Requester 會在 HTTP 請求升級成 WebSocket 連線後被呼叫。
+type Requester interface {
+	Request(http.ResponseWriter, *http.Request, *Session)
+}
+
+// UpgradeErrorHandler 會在 WebSocket 升級失敗時以錯誤與原始 HTTP 請求被呼叫。
+// 升級失敗時 `Upgrader` 就已經回應了 HTTP 錯誤，因此不需要再寫入回應。
+type UpgradeErrorHandler interface {
+	UpgradeError(*http.Request, error)
+}
+
+// Admitter 會在每個 HTTP 請求升級成 WebSocket 之前被呼叫，並決定是否准許連線，
+// 這能夠用來驗證身份並在 `Connect` 之前就將使用者資訊存入階段。
+// 回傳 `nil` 表示以預設方式准許連線。
+type Admitter interface {
+	Admit(*http.Request) *Admission
+}
+
+// Admission 是連線在升級之前的准入結果。
+type Admission struct {
+	// Status 是拒絕連線時要回應的 HTTP 狀態碼（如：`http.StatusUnauthorized`），設置為 `0` 表示准許連線。
+	Status int
+	// Header 是回應時一併傳送的 HTTP 標頭，不論是否准許連線都會被傳送。
+	Header http.Header
+	// Subprotocol 是要與客戶端使用的子協定，設置為空字串則會交由 `Upgrader` 協商。
+	Subprotocol string
+	// Store 是會在 `Connect` 之前預先存入新階段的資料（如：使用者編號、角色）。
+	Store map[string]interface{}
+}
+
+// HandlerFuncs 是以函式欄位組成的處理函式，只需要設置所需要的事件，未設置的事件會被直接忽略。
+type HandlerFuncs struct {
+	OnClose             func(*Session, CloseStatus, string) error
+	OnConnect           func(*Session)
+	OnDisconnect        func(*Session)
+	OnError             func(*Session, error)
+	OnMessage           func(*Session, string)
+	OnMessageBinary     func(*Session, []byte)
+	OnSentMessage       func(*Session, string)
+	OnSentMessageBinary func(*Session, []byte)
+	OnPing              func(*Session)
+	OnPong              func(*Session)
+	OnRequest           func(http.ResponseWriter, *http.Request, *Session)
+	OnUpgradeError      func(*http.Request, error)
+	OnAdmit             func(*http.Request) *Admission
+}
+
+// newHandlerFuncs 會將處理函式有實作的介面轉換成 `HandlerFuncs`，
+// 如此一來引擎就不需要在每次事件發生時都檢查處理函式是否有實作該介面。
+func newHandlerFuncs(handler interface{}) *HandlerFuncs {
+	if h, ok := handler.(*HandlerFuncs); ok {
+		return h
+	}
+	h := &HandlerFuncs{}
+	if v, ok := handler.(Closer); ok {
+		h.OnClose = v.Close
+	}
+	if v, ok := handler.(Connecter); ok {
+		h.OnConnect = v.Connect
+	}
+	if v, ok := handler.(Disconnecter); ok {
+		h.OnDisconnect = v.Disconnect
+	}
+	if v, ok := handler.(Errorer); ok {
+		h.OnError = v.Error
+	}
+	if v, ok := handler.(Messager); ok {
+		h.OnMessage = v.Message
+	}
+	if v, ok := handler.(BinaryMessager); ok {
+		h.OnMessageBinary = v.MessageBinary
+	}
+	if v, ok := handler.(SentMessager); ok {
+		h.OnSentMessage = v.SentMessage
+	}
+	if v, ok := handler.(SentBinaryMessager); ok {
+		h.OnSentMessageBinary = v.SentMessageBinary
+	}
+	if v, ok := handler.(Pinger); ok {
+		h.OnPing = v.Ping
+	}
+	if v, ok := handler.(Ponger); ok {
+		h.OnPong = v.Pong
+	}
+	if v, ok := handler.(Requester); ok {
+		h.OnRequest = v.Request
+	}
+	if v, ok := handler.(UpgradeErrorHandler); ok {
+		h.OnUpgradeError = v.UpgradeError
+	}
+	if v, ok := handler.(Admitter); ok {
+		h.OnAdmit = v.Admit
+	}
+	return h
+}
+
+// Close 會呼叫 `OnClose`。
+func (h *HandlerFuncs) Close(s *Session, status CloseStatus, msg string) error {
+	if h.OnClose == nil {
+		return nil
+	}
+	return h.OnClose(s, status, msg)
+}
+
+// Connect 會呼叫 `OnConnect`。
+func (h *HandlerFuncs) Connect(s *Session) {
+	if h.OnConnect != nil {
+		h.OnConnect(s)
+	}
+}
+
+// Disconnect 會呼叫 `OnDisconnect`。
+func (h *HandlerFuncs) Disconnect(s *Session) {
+	if h.OnDisconnect != nil {
+		h.OnDisconnect(s)
+	}
+}
+
+// Error 會呼叫 `OnError`。
+func (h *HandlerFuncs) Error(s *Session, err error) {
+	if h.OnError != nil {
+		h.OnError(s, err)
+	}
+}
+
+// Message 會呼叫 `OnMessage`。
+func (h *HandlerFuncs) Message(s *Session, msg string) {
+	if h.OnMessage != nil {
+		h.OnMessage(s, msg)
+	}
+}
+
+// MessageBinary 會呼叫 `OnMessageBinary`。
+func (h *HandlerFuncs) MessageBinary(s *Session, msg []byte) {
+	if h.OnMessageBinary != nil {
+		h.OnMessageBinary(s, msg)
+	}
+}
+
+// SentMessage 會呼叫 `OnSentMessage`。
+func (h *HandlerFuncs) SentMessage(s *Session, msg string) {
+	if h.OnSentMessage != nil {
+		h.OnSentMessage(s, msg)
+	}
+}
+
+// SentMessageBinary 會呼叫 `OnSentMessageBinary`。
+func (h *HandlerFuncs) SentMessageBinary(s *Session, msg []byte) {
+	if h.OnSentMessageBinary != nil {
+		h.OnSentMessageBinary(s, msg)
+	}
+}
+
+// Ping 會呼叫 `OnPing`。
+func (h *HandlerFuncs) Ping(s *Session) {
+	if h.OnPing != nil {
+		h.OnPing(s)
+	}
+}
+
+// Pong 會呼叫 `OnPong`。
+func (h *HandlerFuncs) Pong(s *Session) {
+	if h.OnPong != nil {
+		h.OnPong(s)
+	}
+}
+
+// Request 會呼叫 `OnRequest`。
+func (h *HandlerFuncs) Request(w http.ResponseWriter, r *http.Request, s *Session) {
+	if h.OnRequest != nil {
+		h.OnRequest(w, r, s)
+	}
+}
+
+// UpgradeError 會呼叫 `OnUpgradeError`。
+func (h *HandlerFuncs) UpgradeError(r *http.Request, err error) {
+	if h.OnUpgradeError != nil {
+		h.OnUpgradeError(r, err)
+	}
+}
+
+// Admit 會呼叫 `OnAdmit`，未設置時則以預設方式准許連線。
+func (h *HandlerFuncs) Admit(r *http.Request) *Admission {
+	if h.OnAdmit == nil {
+		return nil
+	}
+	return h.OnAdmit(r)
+}
@@ -0,0 +1,92 @@
+package junipero
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Handshake 是客戶端升級成 WebSocket 連線時的 HTTP 請求快照，
+// 這在連線期間是唯讀的，所有回傳的資料都是複本。
+type Handshake struct {
+	// request 是升級請求的複本。
+	request *http.Request
+	// subprotocol 是與客戶端協商後使用的子協定。
+	subprotocol string
+	// extensions 是與客戶端協商後啟用的擴展。
+	extensions []string
+}
+
+// newHandshake 會依照升級請求與升級後的連線建立一個握手快照。
+func newHandshake(r *http.Request, c *websocket.Conn, u *websocket.Upgrader) *Handshake {
+	h := &Handshake{
+		request:     r.Clone(r.Context()),
+		subprotocol: c.Subprotocol(),
+	}
+	// 升級時只會在雙方都支援的情況下啟用 `permessage-deflate` 壓縮擴展。
+	if u.EnableCompression {
+		for _, v := range r.Header.Values("Sec-Websocket-Extensions") {
+			for _, ext := range strings.Split(v, ",") {
+				name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+				if name == "permessage-deflate" {
+					h.extensions = []string{name}
+				}
+			}
+		}
+	}
+	return h
+}
+
+// RemoteAddr 會回傳客戶端的網路位置（如：`127.0.0.1:1234`）。
+func (h *Handshake) RemoteAddr() string {
+	return h.request.RemoteAddr
+}
+
+// Host 會回傳客戶端請求的主機名稱。
+func (h *Handshake) Host() string {
+	return h.request.Host
+}
+
+// URL 會回傳客戶端請求的網址複本。
+func (h *Handshake) URL() *url.URL {
+	u := *h.request.URL
+	return &u
+}
+
+// Query 會回傳客戶端請求網址中的查詢參數。
+func (h *Handshake) Query() url.Values {
+	return h.request.URL.Query()
+}
+
+// Header 會回傳客戶端請求的 HTTP 標頭複本。
+func (h *Handshake) Header() http.Header {
+	return h.request.Header.Clone()
+}
+
+// Cookie 會回傳客戶端請求中指定名稱的 Cookie，不存在時則回傳 `http.ErrNoCookie`。
+func (h *Handshake) Cookie(name string) (*http.Cookie, error) {
+	return h.request.Cookie(name)
+}
+
+// Cookies 會回傳客戶端請求中的所有 Cookie。
+func (h *Handshake) Cookies() []*http.Cookie {
+	return h.request.Cookies()
+}
+
+// TLS 會回傳客戶端連線的 TLS 狀態，若不是經由 TLS 連線則回傳 `nil`。
+func (h *Handshake) TLS() *tls.ConnectionState {
+	return h.request.TLS
+}
+
+// Subprotocol 會回傳與客戶端協商後使用的子協定，沒有使用子協定時則回傳空字串。
+func (h *Handshake) Subprotocol() string {
+	return h.subprotocol
+}
+
+// Extensions 會回傳與客戶端協商後啟用的擴展（如：`permessage-deflate`）。
+func (h *Handshake) Extensions() []string {
+	return append([]string(nil), h.extensions...)
+}
@@ -0,0 +1,88 @@
+package junipero
+
+import (
+	"reflect"
+	"sync"
+)
+
+// storeIndex 是階段存儲資料的索引，能夠依照指定鍵名的資料找出對應的階段，
+// 只有 `EngineConfig.IndexedKeys` 中的鍵名與可以比較的資料才會被索引。
+type storeIndex struct {
+	// entries 在建立後便不會再增減鍵名，因此判斷鍵名是否有被索引時不需要鎖定。
+	entries map[string]map[interface{}]map[string]*Session
+	// mu 保護了 `entries` 中各個鍵名底下的資料。
+	mu sync.RWMutex
+}
+
+// newStoreIndex 會建立指定鍵名的存儲資料索引。
+func newStoreIndex(keys []string) *storeIndex {
+	x := &storeIndex{entries: make(map[string]map[interface{}]map[string]*Session, len(keys))}
+	for _, k := range keys {
+		x.entries[k] = make(map[interface{}]map[string]*Session)
+	}
+	return x
+}
+
+// indexed 會表示指定的鍵名與資料是否能被索引。
+func (x *storeIndex) indexed(k string, v interface{}) bool {
+	if _, ok := x.entries[k]; !ok {
+		return false
+	}
+	return v == nil || reflect.TypeOf(v).Comparable()
+}
+
+// add 會將階段以指定的鍵名與資料加入索引。
+func (x *storeIndex) add(s *Session, k string, v interface{}) {
+	if !x.indexed(k, v) {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sessions, ok := x.entries[k][v]
+	if !ok {
+		sessions = make(map[string]*Session)
+		x.entries[k][v] = sessions
+	}
+	sessions[s.id] = s
+}
+
+// remove 會將階段從指定的鍵名與資料的索引中移除。
+func (x *storeIndex) remove(s *Session, k string, v interface{}) {
+	if !x.indexed(k, v) {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sessions := x.entries[k][v]
+	delete(sessions, s.id)
+	if len(sessions) == 0 {
+		delete(x.entries[k], v)
+	}
+}
+
+// lookup 會回傳存儲資料中指定鍵名為指定資料的所有階段。
+func (x *storeIndex) lookup(k string, v interface{}) []*Session {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	sessions := make([]*Session, 0, len(x.entries[k][v]))
+	for _, s := range x.entries[k][v] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Lookup 會回傳存儲資料中指定鍵名為指定資料的所有客戶端階段（如：`user_id` 為 `42` 的所有裝置）。
+// 鍵名有被設置於 `IndexedKeys` 時會直接使用索引，否則會逐一比對所有客戶端階段。
+func (e *Engine) Lookup(k string, v interface{}) []*Session {
+	if e.index.indexed(k, v) {
+		return e.index.lookup(k, v)
+	}
+	// 無法比較的資料在比對時會造成 `panic`。
+	if v != nil && !reflect.TypeOf(v).Comparable() {
+		return nil
+	}
+	return filter(e.snapshot(), func(s *Session) bool {
+		sv, ok := s.Get(k)
+		return ok && sv == v
+	})
+}
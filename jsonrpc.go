@@ -0,0 +1,434 @@
+package junipero
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// JSON-RPC 2.0 規範中所定義的標準錯誤代號。
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	// JSONRPCServerError 是方法處理函式回傳一般錯誤時所使用的錯誤代號。
+	JSONRPCServerError = -32000
+)
+
+// jsonrpcMessages 是標準錯誤代號的預設錯誤訊息。
+var jsonrpcMessages = map[int]string{
+	JSONRPCParseError:     "Parse error",
+	JSONRPCInvalidRequest: "Invalid Request",
+	JSONRPCMethodNotFound: "Method not found",
+	JSONRPCInvalidParams:  "Invalid params",
+	JSONRPCInternalError:  "Internal error",
+	JSONRPCServerError:    "Server error",
+}
+
+// JSONRPCError 是 JSON-RPC 2.0 的錯誤物件，方法處理函式可以直接回傳此錯誤來指定錯誤代號。
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// NewJSONRPCError 會建立一個帶有指定錯誤代號與其預設錯誤訊息的錯誤。
+func NewJSONRPCError(code int) *JSONRPCError {
+	return &JSONRPCError{Code: code, Message: jsonrpcMessages[code]}
+}
+
+// Error 會回傳 JSON-RPC 錯誤的描述。
+func (e *JSONRPCError) Error() string {
+	return "junipero: json-rpc error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// JSONRPCRequest 是 JSON-RPC 2.0 的請求物件，沒有 `ID` 的請求是通知。
+type JSONRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// JSONRPCResponse 是 JSON-RPC 2.0 的回應物件。
+type JSONRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// JSONRPC 是 JSON-RPC 2.0 協定模式的處理函式，會將接收到的文字訊息視為 JSON-RPC 請求、通知或是批次請求，
+// 並回應其結果。其他的事件則會交由原本的處理函式處理，這可以直接傳入 `NewServer`。
+type JSONRPC struct {
+	*HandlerFuncs
+
+	// mu 保護了方法處理函式。
+	mu      sync.RWMutex
+	methods map[string]MethodHandler
+}
+
+// NewJSONRPC 會建立一個包裝了指定處理函式的 JSON-RPC 2.0 協定處理函式，處理函式可以是 `nil`。
+func NewJSONRPC(handler interface{}) *JSONRPC {
+	return &JSONRPC{
+		HandlerFuncs: newHandlerFuncs(handler),
+		methods:      make(map[string]MethodHandler),
+	}
+}
+
+// Handle 會註冊能夠被客戶端呼叫的方法，重複註冊同一個方法會覆蓋先前的處理函式。
+// 處理函式回傳的 `*JSONRPCError` 會原封不動地回應給客戶端，其他錯誤則會以 `JSONRPCServerError` 回應。
+// 每個請求或批次請求都會在各自的 goroutine 中執行，因此執行較久的方法不會阻塞讀取迴圈處理 Pong 與其他請求。
+func (j *JSONRPC) Handle(method string, fn MethodHandler) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.methods[method] = fn
+}
+
+// Message 會處理客戶端的 JSON-RPC 請求並回應其結果，通知與全部都是通知的批次請求不會有任何回應。
+func (j *JSONRPC) Message(s *Session, msg string) {
+	go func() {
+		resp, err := j.serve(s, []byte(msg))
+		if err != nil {
+			j.Error(s, err)
+			return
+		}
+		if resp != nil {
+			s.Write(string(resp))
+		}
+	}()
+}
+
+// serve 會處理單個或是批次請求，並回傳編碼後的回應，沒有回應時則回傳 `nil`。
+func (j *JSONRPC) serve(s *Session, data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return json.Marshal(newJSONRPCResponse(nil, nil, NewJSONRPCError(JSONRPCParseError)))
+	}
+	if data[0] != '[' {
+		resp := j.handle(s, data)
+		if resp == nil {
+			return nil, nil
+		}
+		return json.Marshal(resp)
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+		return json.Marshal(newJSONRPCResponse(nil, nil, NewJSONRPCError(JSONRPCInvalidRequest)))
+	}
+	var resps []*JSONRPCResponse
+	for _, v := range batch {
+		if resp := j.handle(s, v); resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(resps)
+}
+
+// handle 會處理單個請求並回傳其回應，通知則會回傳 `nil`。
+func (j *JSONRPC) handle(s *Session, data json.RawMessage) *JSONRPCResponse {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return newJSONRPCResponse(nil, nil, NewJSONRPCError(JSONRPCInvalidRequest))
+	}
+	id, hasID := fields["id"]
+	if hasID && !isJSONRPCID(id) {
+		return newJSONRPCResponse(nil, nil, NewJSONRPCError(JSONRPCInvalidRequest))
+	}
+	var version, method string
+	params := bytes.TrimSpace(fields["params"])
+	if json.Unmarshal(fields["jsonrpc"], &version) != nil || version != "2.0" ||
+		json.Unmarshal(fields["method"], &method) != nil ||
+		(len(params) != 0 && params[0] != '[' && params[0] != '{') {
+		return newJSONRPCResponse(id, nil, NewJSONRPCError(JSONRPCInvalidRequest))
+	}
+	j.mu.RLock()
+	fn, ok := j.methods[method]
+	j.mu.RUnlock()
+	if !hasID {
+		if ok {
+			fn(s, params)
+		}
+		return nil
+	}
+	if !ok {
+		return newJSONRPCResponse(id, nil, NewJSONRPCError(JSONRPCMethodNotFound))
+	}
+	result, err := fn(s, params)
+	if err != nil {
+		var rpcErr *JSONRPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &JSONRPCError{Code: JSONRPCServerError, Message: err.Error()}
+		}
+		return newJSONRPCResponse(id, nil, rpcErr)
+	}
+	data, err = json.Marshal(result)
+	if err != nil {
+		return newJSONRPCResponse(id, nil, NewJSONRPCError(JSONRPCInternalError))
+	}
+	return newJSONRPCResponse(id, data, nil)
+}
+
+// newJSONRPCResponse 會建立一個回應，沒有編號時會以 `null` 作為編號。
+func newJSONRPCResponse(id, result json.RawMessage, err *JSONRPCError) *JSONRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &JSONRPCResponse{JSONRPC: "2.0", Result: result, Error: err, ID: id}
+}
+
+// isJSONRPCID 會表示指定的 JSON 值是否為合法的請求編號，只能是字串、數字或 `null`。
+func isJSONRPCID(id json.RawMessage) bool {
+	id = bytes.TrimSpace(id)
+	if len(id) == 0 {
+		return false
+	}
+	switch c := id[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	}
+	return string(id) == "null"
+}
+
+// newJSONRPCRequest 會建立一個請求或是通知，`id` 為 `nil` 時表示通知。
+func newJSONRPCRequest(method string, params interface{}, id json.RawMessage) (*JSONRPCRequest, error) {
+	req := &JSONRPCRequest{JSONRPC: "2.0", Method: method, ID: id}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req.Params = data
+	}
+	return req, nil
+}
+
+// Notify 會傳送 JSON-RPC 2.0 通知給客戶端，通知不會有任何回應。
+func (s *Session) Notify(method string, params interface{}) error {
+	req, err := newJSONRPCRequest(method, params, nil)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return s.Write(string(msg))
+}
+
+// JSONRPCClient 是使用 JSON-RPC 2.0 協定的 WebSocket 客戶端，
+// 所有接收到的訊息都會在背景中被讀取並交由等待中的呼叫或通知處理函式處理。
+type JSONRPCClient struct {
+	// client 是底層的 WebSocket 客戶端。
+	client *Client
+	// done 會在讀取迴圈結束時被關閉。
+	done chan struct{}
+
+	// mu 保護了下列的呼叫與通知處理函式欄位。
+	mu            sync.Mutex
+	lastID        uint64
+	calls         map[string]chan *JSONRPCResponse
+	notifications map[string]func(json.RawMessage)
+}
+
+// JSONRPCCall 是批次請求中的單個呼叫，回應後會設置 `Result` 或 `Error`。
+type JSONRPCCall struct {
+	Method string
+	Params interface{}
+	// Notification 表示此呼叫是通知，不會有任何回應。
+	Notification bool
+	Result       json.RawMessage
+	Error        *JSONRPCError
+}
+
+// NewJSONRPCClient 會建立使用 JSON-RPC 2.0 協定的客戶端並連線到指定的 WebSocket 伺服端。
+func NewJSONRPCClient(conf *ClientConfig) (*JSONRPCClient, *http.Response, error) {
+	client, resp, err := NewClient(conf)
+	if err != nil {
+		return nil, resp, err
+	}
+	c := &JSONRPCClient{
+		client:        client,
+		done:          make(chan struct{}),
+		calls:         make(map[string]chan *JSONRPCResponse),
+		notifications: make(map[string]func(json.RawMessage)),
+	}
+	go c.readLoop()
+	return c, resp, nil
+}
+
+// readLoop 會持續讀取伺服端的回應與通知，直到連線中斷為止，中斷後客戶端也會被關閉。
+func (c *JSONRPCClient) readLoop() {
+	defer close(c.done)
+	for {
+		typ, msg, err := c.client.ReadAll()
+		if err != nil {
+			c.client.Close()
+			return
+		}
+		if typ != TextMessage {
+			continue
+		}
+		msg = bytes.TrimSpace(msg)
+		if len(msg) == 0 {
+			continue
+		}
+		if msg[0] != '[' {
+			c.dispatch(msg)
+			continue
+		}
+		var batch []json.RawMessage
+		if err := json.Unmarshal(msg, &batch); err != nil {
+			continue
+		}
+		for _, v := range batch {
+			c.dispatch(v)
+		}
+	}
+}
+
+// dispatch 會將單個回應交給等待中的呼叫，或是將通知交給對應的處理函式。
+func (c *JSONRPCClient) dispatch(data json.RawMessage) {
+	var msg struct {
+		JSONRPCResponse
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Method != "" {
+		if fn, ok := c.notifications[msg.Method]; ok {
+			go fn(msg.Params)
+		}
+		return
+	}
+	if reply, ok := c.calls[string(msg.ID)]; ok {
+		delete(c.calls, string(msg.ID))
+		reply <- &msg.JSONRPCResponse
+	}
+}
+
+// add 會登記一個新的呼叫，並回傳其編號與接收回應的通道。
+func (c *JSONRPCClient) add() (json.RawMessage, chan *JSONRPCResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastID++
+	id := strconv.FormatUint(c.lastID, 10)
+	reply := make(chan *JSONRPCResponse, 1)
+	c.calls[id] = reply
+	return json.RawMessage(id), reply
+}
+
+// remove 會移除指定編號的呼叫。
+func (c *JSONRPCClient) remove(id json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.calls, string(id))
+}
+
+// wait 會等待指定的回應，直到 `ctx` 逾時、被取消或是連線中斷為止。
+func (c *JSONRPCClient) wait(ctx context.Context, reply chan *JSONRPCResponse) (*JSONRPCResponse, error) {
+	select {
+	case resp := <-reply:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrConnectionClosed
+	}
+}
+
+// write 會將請求以 JSON 編碼後寫入至伺服端。
+func (c *JSONRPCClient) write(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.client.Write(string(msg))
+}
+
+// Call 會呼叫伺服端的方法並等待其回應，直到 `ctx` 逾時或被取消為止。伺服端回應的錯誤會是 `*JSONRPCError`。
+func (c *JSONRPCClient) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id, reply := c.add()
+	defer c.remove(id)
+	req, err := newJSONRPCRequest(method, params, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.wait(ctx, reply)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+// Notify 會傳送通知給伺服端，通知不會有任何回應。
+func (c *JSONRPCClient) Notify(method string, params interface{}) error {
+	req, err := newJSONRPCRequest(method, params, nil)
+	if err != nil {
+		return err
+	}
+	return c.write(req)
+}
+
+// Batch 會以批次請求一次傳送多個呼叫並等待所有回應，每個呼叫的結果會被設置在該呼叫的 `Result` 或 `Error`。
+func (c *JSONRPCClient) Batch(ctx context.Context, calls ...*JSONRPCCall) error {
+	reqs := make([]*JSONRPCRequest, len(calls))
+	replies := make([]chan *JSONRPCResponse, len(calls))
+	for i, v := range calls {
+		var id json.RawMessage
+		if !v.Notification {
+			id, replies[i] = c.add()
+			defer c.remove(id)
+		}
+		req, err := newJSONRPCRequest(v.Method, v.Params, id)
+		if err != nil {
+			return err
+		}
+		reqs[i] = req
+	}
+	if err := c.write(reqs); err != nil {
+		return err
+	}
+	for i, v := range calls {
+		if replies[i] == nil {
+			continue
+		}
+		resp, err := c.wait(ctx, replies[i])
+		if err != nil {
+			return err
+		}
+		v.Result, v.Error = resp.Result, resp.Error
+	}
+	return nil
+}
+
+// OnNotification 會註冊伺服端通知的處理函式，重複註冊同一個通知會覆蓋先前的處理函式。
+func (c *JSONRPCClient) OnNotification(method string, fn func(json.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notifications[method] = fn
+}
+
+// Close 會關閉並結束客戶端連線。
+func (c *JSONRPCClient) Close() error {
+	return c.client.Close()
+}
@@ -1,59 +1,135 @@
 package junipero
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Engine 是 WebSocket 引擎。
+// Engine 是 WebSocket 引擎，可以安全地被多個 goroutine 同時使用。
 type Engine struct {
-	handler  Handler
-	sessions map[int]*Session
+	// dropped 是所有階段因寫入佇列已滿而被拋棄的訊息總數，
+	// 為了在 32 位元平台上能夠以 atomic 存取，這必須是第一個欄位。
+	dropped uint64
+	handler *HandlerFuncs
+	config  *EngineConfig
+	// routed 表示處理函式是否為 `Router`，只有 `Router` 才能將客戶端的回應交給 `Session.Call`。
+	routed bool
+
+	// sessions 是所有連線中的階段，以階段編號分片存放。
+	sessions sessionMap
+	// index 是階段存儲資料的索引。
+	index *storeIndex
+	// users 是綁定了使用者的階段。
+	users userMap
+
+	// mu 保護了下列的頻道與狀態欄位。
+	mu       sync.RWMutex
 	channels map[string]*Channel
-	config   *EngineConfig
 	isClosed bool
-	lastID   int
+	// closeStatus 與 closeReason 是關閉引擎時所使用的狀態代號與原因，
+	// 在關閉期間才完成升級的連線也會以此關閉。
+	closeStatus CloseStatus
+	closeReason string
+
+	// wg 追蹤了所有仍在處理中的連線與寫入迴圈，用以在關閉引擎時等待其結束。
+	wg sync.WaitGroup
 }
 
 // EngineConfig 是引擎選項設置。
 type EngineConfig struct {
 	// WriteWait 是到逾時之前的等待時間。
 	WriteWait time.Duration
+	// CloseTimeout 是傳送關閉訊息後等待客戶端回應關閉訊息的時間，逾時後會直接中斷連線。
+	// 設置為 `0` 則會沿用 `WriteWait`，兩者皆為 `0` 時預設為 5 秒。
+	CloseTimeout time.Duration
+	// SendQueueSize 是每個階段寫入佇列的大小，
+	// 佇列已滿時會依照 `OverflowPolicy` 處理。
+	SendQueueSize int
+	// OverflowPolicy 是寫入佇列已滿時的處理方式，預設會拋棄最新的訊息。
+	OverflowPolicy OverflowPolicy
+	// OverflowTimeout 是 `OverflowBlock` 策略等待佇列空間的時間，
+	// 設置為 `0` 則會沿用 `WriteWait`，兩者皆為 `0` 時則會一直等到佇列有空間或是階段關閉為止。
+	OverflowTimeout time.Duration
 	// PongWait 是等待 Pong 回應的時間，在指定時間內客戶端如果沒有任何響應，該 WebSocket 連線則會被迫中止。
 	// 設置為 `0` 來停用無響應自動斷線的功能。
 	PongWait time.Duration
-	// PingPeriod 是 Ping 的週期時間。
+	// PingPeriod 是引擎主動向每個客戶端發送 Ping 的週期時間，這必須比 `PongWait` 還要短。
+	// 設置為 `0` 時會以 `PongWait` 的十分之九作為週期，若兩者皆為 `0` 則不會發送 Ping。
 	PingPeriod time.Duration
 	// MaxMessageSize 是最大可接收的訊息位元組大小，
 	// 溢出此大小的訊息會被拋棄。
 	MaxMessageSize int64
 	// Upgrader 是 WebSocket 升級的相關設置。
 	Upgrader *websocket.Upgrader
-}
-
-// Handler 是 WebSocket 訊息和相關功能的處理函式。
-type Handler interface {
-	Close(*Session, CloseStatus, string) error
-	Connect(*Session)
-	Disconnect(*Session)
-	Error(*Session, error)
-	Message(*Session, string)
-	MessageBinary(*Session, []byte)
-	SentMessage(*Session, string)
-	SentMessageBinary(*Session, []byte)
-	Ping(*Session)
-	Pong(*Session)
-	Request(http.ResponseWriter, *http.Request, *Session)
+	// IDGenerator 會產生每個階段的獨立編號，產生的編號必須在引擎中是唯一的。
+	// 設置為 `nil` 則會使用 `RandomID` 產生隨機且能用於網址的字串編號。
+	IDGenerator func() string
+	// IndexedKeys 是需要被索引的階段存儲資料鍵名，能夠讓 `Lookup` 以這些鍵名快速找出對應的階段。
+	IndexedKeys []string
+	// MaxSessionsPerUser 是每個使用者能夠同時綁定的階段數量上限，設置為 `0` 則不限制。
+	MaxSessionsPerUser int
+	// CloseOnBroadcastFailure 表示廣播時若客戶端寫入失敗或因寫入佇列已滿而被拋棄，
+	// 是否要以 `ClosePolicyViolation` 自動中斷該客戶端的連線。
+	CloseOnBroadcastFailure bool
+	// BroadcastWorkers 是廣播時同時寫入客戶端的 goroutine 數量，設置為 `0` 則會以 `runtime.GOMAXPROCS` 為準，
+	// 設置為 `1` 則會在呼叫者的 goroutine 中依序寫入所有客戶端。
+	BroadcastWorkers int
+	// BroadcastBatchSize 是廣播時每個 goroutine 一次負責寫入的客戶端數量，預設為 `1024`。
+	// 廣播的客戶端數量不超過此數量時則會直接在呼叫者的 goroutine 中寫入。
+	BroadcastBatchSize int
+	// Codec 是 `WriteValue` 與廣播資料時預設的編碼方式，設置為 `nil` 則會使用 `JSONCodec`。
+	Codec Codec
+	// Codecs 是以子協定名稱對應的編碼方式，客戶端協商了其中的子協定時便會使用對應的編碼方式。
+	// 如果 `Upgrader` 沒有設置 `Subprotocols`，則會依照名稱排序以這些子協定進行協商。
+	Codecs map[string]Codec
 }
 
 // NewServer 會建立一個新的 WebSocket 伺服器。
-func NewServer(conf *EngineConfig, handler Handler) *Engine {
+// 處理函式可以是完整實作了 `Handler` 的結構體、僅實作部分介面（如：`Messager`）的結構體，或是 `*HandlerFuncs`。
+func NewServer(conf *EngineConfig, handler interface{}) *Engine {
+	if conf.Upgrader == nil {
+		conf.Upgrader = &websocket.Upgrader{}
+	}
+	if conf.SendQueueSize == 0 {
+		conf.SendQueueSize = 256
+	}
+	if conf.CloseTimeout == 0 {
+		conf.CloseTimeout = conf.WriteWait
+	}
+	if conf.CloseTimeout == 0 {
+		conf.CloseTimeout = 5 * time.Second
+	}
+	if conf.PingPeriod == 0 {
+		conf.PingPeriod = conf.PongWait * 9 / 10
+	}
+	if conf.IDGenerator == nil {
+		conf.IDGenerator = RandomID
+	}
+	if conf.BroadcastWorkers == 0 {
+		conf.BroadcastWorkers = runtime.GOMAXPROCS(0)
+	}
+	if conf.BroadcastBatchSize == 0 {
+		conf.BroadcastBatchSize = 1024
+	}
+	if len(conf.Codecs) != 0 && len(conf.Upgrader.Subprotocols) == 0 {
+		u := *conf.Upgrader
+		u.Subprotocols = subprotocols(conf.Codecs)
+		conf.Upgrader = &u
+	}
+	_, routed := handler.(*Router)
 	return &Engine{
-		handler:  handler,
+		routed:   routed,
+		handler:  newHandlerFuncs(handler),
 		config:   conf,
-		sessions: make(map[int]*Session),
+		index:    newStoreIndex(conf.IndexedKeys),
 		channels: make(map[string]*Channel),
 	}
 }
@@ -61,10 +137,12 @@ func NewServer(conf *EngineConfig, handler Handler) *Engine {
 // DefaultConfig 會回傳一個新的預設引擎設置。
 func DefaultConfig() *EngineConfig {
 	return &EngineConfig{
-		WriteWait:      30,
-		PongWait:       10,
-		PingPeriod:     20,
+		WriteWait:      30 * time.Second,
+		CloseTimeout:   5 * time.Second,
+		PongWait:       60 * time.Second,
+		PingPeriod:     54 * time.Second,
 		MaxMessageSize: 10 * 1024 * 1024,
+		SendQueueSize:  256,
 		Upgrader: &websocket.Upgrader{
 			HandshakeTimeout: 30 * time.Second,
 			ReadBufferSize:   1024,
@@ -74,158 +152,331 @@ func DefaultConfig() *EngineConfig {
 }
 
 // HandlerFunc 是用以傳入 HTTP 伺服器協助升級與接收 WebSocket 相關資訊的最重要函式。
+// 由於引擎本身就實作了 `http.Handler`，也可以直接將引擎傳入 HTTP 伺服器。
 func (e *Engine) HandlerFunc() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if e.isClosed {
-			panic(ErrEngineClosed)
-		}
-		c, err := e.config.Upgrader.Upgrade(w, r, nil)
-		s := e.NewSession(c)
-		if err != nil {
-			e.handler.Error(s, err)
-			return
+	return e.ServeHTTP
+}
+
+// ServeHTTP 會將 HTTP 請求升級為 WebSocket 連線並處理該連線直到其結束。
+// 引擎已經關閉時會以 HTTP 503 拒絕請求；若處理函式有實作 `Admitter` 則會在升級前決定是否准許連線。
+// 升級失敗時則不會建立任何客戶端階段，若處理函式有實作 `UpgradeErrorHandler` 則會將錯誤傳入 `UpgradeError`。
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.admit() {
+		http.Error(w, ErrEngineClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer e.wg.Done()
+	a := e.handler.Admit(r)
+	if a == nil {
+		a = &Admission{}
+	}
+	header := a.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+	if a.Status != 0 {
+		for k, v := range header {
+			w.Header()[k] = v
 		}
-		e.handler.Request(w, r, s)
-
-		c.SetPingHandler(func(m string) error {
-			e.handler.Ping(s)
-			s.Pong()
-			return nil
-		})
-		c.SetPongHandler(func(m string) error {
-			e.handler.Pong(s)
-			return nil
-		})
-		c.SetCloseHandler(func(code int, msg string) error {
-			s.Close()
-			e.handler.Close(s, CloseStatus(code), msg)
-			if CloseStatus(code) == CloseNormalClosure {
-				e.handler.Disconnect(s)
-			}
-			return nil
-		})
+		http.Error(w, http.StatusText(a.Status), a.Status)
+		return
+	}
+	upgrader := e.config.Upgrader
+	if a.Subprotocol != "" {
+		// `Upgrader` 只有在沒有設置 `Subprotocols` 時才會採用回應標頭中的子協定。
+		u := *upgrader
+		u.Subprotocols = nil
+		upgrader = &u
+		header.Set("Sec-WebSocket-Protocol", a.Subprotocol)
+	}
+	c, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		e.handler.UpgradeError(r, err)
+		return
+	}
+	s := e.newSession(r.Context(), c, newHandshake(r, c, upgrader), a.Store)
+	e.handler.Request(w, r, s)
+
+	s.extendReadDeadline()
+	c.SetPingHandler(func(m string) error {
+		s.extendReadDeadline()
+		e.handler.Ping(s)
+		s.Pong()
+		return nil
+	})
+	c.SetPongHandler(func(m string) error {
+		s.extendReadDeadline()
+		e.handler.Pong(s)
+		return nil
+	})
+	c.SetCloseHandler(func(code int, msg string) error {
+		e.handler.Close(s, CloseStatus(code), msg)
+		s.close(websocket.FormatCloseMessage(code, ""), &CloseError{Status: CloseStatus(code), Reason: msg})
+		return nil
+	})
 
-		e.handler.Connect(s)
+	e.handler.Connect(s)
 
-		defer func() {
-			s.Close()
-		}()
+	// 在關閉引擎之前就已經通過 `admit` 的連線可能在關閉之後才完成升級，
+	// 此時需要以關閉引擎時的狀態代號關閉，否則將不會被關閉。
+	if status, reason, ok := e.closed(); ok {
+		s.CloseWithStatus(status, reason)
+	}
+
+	// 讀取迴圈結束時表示連線已經中斷或是完成了關閉交握，
+	// 此時已經無法再傳送關閉訊息給客戶端了。
+	var readErr error
+	defer func() {
+		close(s.readDone)
+		s.close(nil, readErr)
+	}()
 
-		for {
-			typ, msg, err := c.ReadMessage()
-			if err != nil {
-				if !s.isClosed {
-					s.Close()
+	for {
+		typ, msg, err := c.ReadMessage()
+		if err != nil {
+			readErr = err
+			if !s.IsClosed() {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					readErr = ErrSessionTimedOut
+					e.handler.Error(s, ErrSessionTimedOut)
+					e.handler.Close(s, CloseAbnormalClosure, "pong wait timed out")
+				} else {
 					e.handler.Error(s, err)
 				}
-				break
-			}
-			switch MessageType(typ) {
-			case TextMessage:
-				e.handler.Message(s, string(msg))
-				break
-			case BinaryMessage:
-				e.handler.MessageBinary(s, msg)
-				break
 			}
+			break
+		}
+		switch MessageType(typ) {
+		case TextMessage:
+			e.handler.Message(s, string(msg))
+			break
+		case BinaryMessage:
+			e.handler.MessageBinary(s, msg)
+			break
 		}
 	}
 }
 
-// Broadcast 會將文字訊息傳送到所有連線的客戶端。
-func (e *Engine) Broadcast(msg string) {
-	for _, v := range e.sessions {
-		v.Write(msg)
+// snapshot 會逐一鎖定每個分片並複製一份目前所有的客戶端階段，
+// 這令廣播時不需要長時間持有鎖。
+func (e *Engine) snapshot() []*Session {
+	return e.sessions.snapshot()
+}
+
+// admit 會在引擎尚未關閉時登記一個新的連線處理，引擎已經關閉時則回傳 `false`。
+func (e *Engine) admit() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.isClosed {
+		return false
 	}
+	e.wg.Add(1)
+	return true
+}
+
+// Broadcast 會將文字訊息傳送到所有連線的客戶端，所有廣播的訊息只會被編碼成訊框一次並由所有客戶端共用。
+func (e *Engine) Broadcast(msg string) {
+	e.BroadcastWithReport(msg)
+}
+
+// BroadcastWithReport 與 `Broadcast` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastWithReport(msg string) *BroadcastReport {
+	return e.fanOut(e.snapshot(), newPreparedMessage(TextMessage, []byte(msg)), (*Session).enqueue)
 }
 
 // BroadcastFilter 會將文字訊息傳送到經篩選的客戶端。
 func (e *Engine) BroadcastFilter(msg string, fn func(*Session) bool) {
-	for _, v := range e.sessions {
-		if fn(v) {
-			v.Write(msg)
-		}
-	}
+	e.BroadcastFilterWithReport(msg, fn)
+}
+
+// BroadcastFilterWithReport 與 `BroadcastFilter` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastFilterWithReport(msg string, fn func(*Session) bool) *BroadcastReport {
+	return e.fanOut(filter(e.snapshot(), fn), newPreparedMessage(TextMessage, []byte(msg)), (*Session).enqueue)
 }
 
 // BroadcastOthers 會將文字訊息傳送到指定客戶端以外的所有客戶端。
 func (e *Engine) BroadcastOthers(msg string, s *Session) {
-	for _, v := range e.sessions {
-		if v != s {
-			v.Write(msg)
-		}
-	}
+	e.BroadcastOthersWithReport(msg, s)
+}
+
+// BroadcastOthersWithReport 與 `BroadcastOthers` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastOthersWithReport(msg string, s *Session) *BroadcastReport {
+	return e.fanOut(filter(e.snapshot(), func(v *Session) bool {
+		return v != s
+	}), newPreparedMessage(TextMessage, []byte(msg)), (*Session).enqueue)
 }
 
 // BroadcastMultiple 會將文字訊息傳送到指定客戶端的客戶端們。
 func (e *Engine) BroadcastMultiple(msg string, sessions []*Session) {
-	for _, v := range sessions {
-		v.Write(msg)
-	}
+	e.BroadcastMultipleWithReport(msg, sessions)
+}
+
+// BroadcastMultipleWithReport 與 `BroadcastMultiple` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastMultipleWithReport(msg string, sessions []*Session) *BroadcastReport {
+	return e.fanOut(sessions, newPreparedMessage(TextMessage, []byte(msg)), (*Session).enqueue)
 }
 
 // BroadcastBinary 會將二進制訊息傳送到所有連線的客戶端。
+// 訊息會先被複製，因此呼叫者在回傳後可以繼續使用 `msg`。
 func (e *Engine) BroadcastBinary(msg []byte) {
-	for _, v := range e.sessions {
-		v.WriteBinary(msg)
-	}
+	e.BroadcastBinaryWithReport(msg)
+}
+
+// BroadcastBinaryWithReport 與 `BroadcastBinary` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastBinaryWithReport(msg []byte) *BroadcastReport {
+	return e.fanOut(e.snapshot(), newPreparedMessage(BinaryMessage, cloneBytes(msg)), (*Session).enqueue)
 }
 
 // BroadcastBinaryFilter 會將二進制訊息傳送到經篩選的客戶端。
 func (e *Engine) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) {
-	for _, v := range e.sessions {
-		if fn(v) {
-			v.WriteBinary(msg)
-		}
-	}
+	e.BroadcastBinaryFilterWithReport(msg, fn)
+}
+
+// BroadcastBinaryFilterWithReport 與 `BroadcastBinaryFilter` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastBinaryFilterWithReport(msg []byte, fn func(*Session) bool) *BroadcastReport {
+	return e.fanOut(filter(e.snapshot(), fn), newPreparedMessage(BinaryMessage, cloneBytes(msg)), (*Session).enqueue)
 }
 
 // BroadcastBinaryOthers 會將二進制訊息傳送到指定客戶端以外的所有客戶端。
 func (e *Engine) BroadcastBinaryOthers(msg []byte, s *Session) {
-	for _, v := range e.sessions {
-		if v != s {
-			v.WriteBinary(msg)
-		}
-	}
+	e.BroadcastBinaryOthersWithReport(msg, s)
+}
+
+// BroadcastBinaryOthersWithReport 與 `BroadcastBinaryOthers` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastBinaryOthersWithReport(msg []byte, s *Session) *BroadcastReport {
+	return e.fanOut(filter(e.snapshot(), func(v *Session) bool {
+		return v != s
+	}), newPreparedMessage(BinaryMessage, cloneBytes(msg)), (*Session).enqueue)
 }
 
 // BroadcastBinaryMultiple 會將二進制訊息傳送到指定客戶端的客戶端們。
 func (e *Engine) BroadcastBinaryMultiple(msg []byte, sessions []*Session) {
-	for _, v := range sessions {
-		v.WriteBinary(msg)
-	}
+	e.BroadcastBinaryMultipleWithReport(msg, sessions)
+}
+
+// BroadcastBinaryMultipleWithReport 與 `BroadcastBinaryMultiple` 相同，但會回傳包含了送達、被拋棄與寫入失敗的客戶端的報告。
+func (e *Engine) BroadcastBinaryMultipleWithReport(msg []byte, sessions []*Session) *BroadcastReport {
+	return e.fanOut(sessions, newPreparedMessage(BinaryMessage, cloneBytes(msg)), (*Session).enqueue)
 }
 
 // Close 會關閉整個引擎並中斷所有連線。
 func (e *Engine) Close() {
-	for _, v := range e.sessions {
+	e.markClosed(CloseNormalClosure, "")
+	for _, v := range e.snapshot() {
 		v.Close()
 	}
-	e.isClosed = true
 }
 
 // CloseWithMsg 會關閉引擎並在那之前傳送最後一則文字訊息。
 func (e *Engine) CloseWithMsg(msg string) {
-	for _, v := range e.sessions {
+	e.markClosed(CloseNormalClosure, "")
+	for _, v := range e.snapshot() {
 		v.CloseWithMsg(msg)
 	}
-	e.isClosed = true
 }
 
 // CloseWithBinary 會關閉引擎並在那之前傳送最後一則二進制訊息。
 func (e *Engine) CloseWithBinary(msg []byte) {
-	for _, v := range e.sessions {
+	e.markClosed(CloseNormalClosure, "")
+	for _, v := range e.snapshot() {
 		v.CloseWithBinary(msg)
 	}
-	e.isClosed = true
+}
+
+// Shutdown 會以 `CloseGoingAway` 優雅地關閉引擎，詳細行為請參閱 `ShutdownWithStatus`。
+func (e *Engine) Shutdown(ctx context.Context) error {
+	return e.ShutdownWithStatus(ctx, CloseGoingAway, "server is shutting down")
+}
+
+// ShutdownWithStatus 會優雅地關閉引擎，新的連線會以 HTTP 503 拒絕，
+// 所有客戶端在佇列中的訊息送出後會接收到帶有指定狀態代號與原因的關閉訊息。
+// 此函式會等待所有連線與處理函式結束，若在那之前 `ctx` 就已經逾時或被取消，
+// 剩餘的連線會被強制中斷並回傳 `ctx` 的錯誤。
+func (e *Engine) ShutdownWithStatus(ctx context.Context, status CloseStatus, reason string) error {
+	e.markClosed(status, reason)
+	sessions := e.snapshot()
+	for _, v := range sessions {
+		v.CloseWithStatus(status, reason)
+	}
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// 已經關閉的階段會從引擎中移除，因此除了先前的階段之外還需要加上關閉期間才完成升級的階段。
+		for _, v := range append(sessions, e.snapshot()...) {
+			if v.conn != nil {
+				v.conn.Close()
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// CloseWithStatus 會以指定的狀態代號與原因中斷所有連線並關閉引擎。
+func (e *Engine) CloseWithStatus(status CloseStatus, reason string) {
+	e.markClosed(status, reason)
+	for _, v := range e.snapshot() {
+		v.CloseWithStatus(status, reason)
+	}
+}
+
+// markClosed 會將引擎標記為已關閉，並記下關閉時所使用的狀態代號與原因。
+func (e *Engine) markClosed(status CloseStatus, reason string) {
+	e.mu.Lock()
+	if !e.isClosed {
+		e.isClosed = true
+		e.closeStatus = status
+		e.closeReason = reason
+	}
+	e.mu.Unlock()
+}
+
+// closed 會回傳引擎關閉時所使用的狀態代號與原因，以及引擎是否已經關閉了。
+func (e *Engine) closed() (CloseStatus, string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.closeStatus, e.closeReason, e.isClosed
 }
 
 // IsClosed 會表示該引擎是否已經關閉了。
 func (e *Engine) IsClosed() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.isClosed
 }
 
+// Dropped 會回傳所有階段因寫入佇列已滿而被拋棄的訊息總數。
+func (e *Engine) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
 // Len 會取得正在連線的客戶端總數。
 func (e *Engine) Len() int {
-	return len(e.sessions)
+	return e.sessions.len()
+}
+
+// Session 會回傳指定編號的客戶端階段。
+func (e *Engine) Session(id string) (*Session, bool) {
+	return e.sessions.load(id)
+}
+
+// Sessions 會回傳一份目前所有連線中的客戶端階段複本。
+func (e *Engine) Sessions() map[string]*Session {
+	return e.sessions.copy()
+}
+
+// Range 會依序將目前所有連線中的客戶端階段傳入指定函式，函式回傳 `false` 時則會停止。
+// 這會走訪呼叫當下的階段快照，因此能夠在函式中安全地關閉階段或建立新的階段。
+func (e *Engine) Range(fn func(*Session) bool) {
+	for _, v := range e.snapshot() {
+		if !fn(v) {
+			return
+		}
+	}
 }
@@ -1 +1,1743 @@
 package junipero
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testHandler 是測試用的處理函式，只有被指定的函式會被呼叫。
+type testHandler struct {
+	close      func(*Session, CloseStatus, string)
+	connect    func(*Session)
+	disconnect func(*Session)
+	err        func(*Session, error)
+	message    func(*Session, string)
+}
+
+func (h *testHandler) Close(s *Session, status CloseStatus, msg string) error {
+	if h.close != nil {
+		h.close(s, status, msg)
+	}
+	return nil
+}
+func (h *testHandler) Connect(s *Session) {
+	if h.connect != nil {
+		h.connect(s)
+	}
+}
+func (h *testHandler) Disconnect(s *Session) {
+	if h.disconnect != nil {
+		h.disconnect(s)
+	}
+}
+func (h *testHandler) Error(s *Session, err error) {
+	if h.err != nil {
+		h.err(s, err)
+	}
+}
+func (h *testHandler) Message(s *Session, msg string) {
+	if h.message != nil {
+		h.message(s, msg)
+	}
+}
+func (h *testHandler) MessageBinary(s *Session, msg []byte)                       {}
+func (h *testHandler) SentMessage(s *Session, msg string)                         {}
+func (h *testHandler) SentMessageBinary(s *Session, msg []byte)                   {}
+func (h *testHandler) Ping(s *Session)                                            {}
+func (h *testHandler) Pong(s *Session)                                            {}
+func (h *testHandler) Request(w http.ResponseWriter, r *http.Request, s *Session) {}
+
+// newTestServer 會建立一個測試用的引擎與 HTTP 伺服器，並回傳 WebSocket 的連線位置。
+func newTestServer(t testing.TB, conf *EngineConfig, h interface{}) (*Engine, string) {
+	e := NewServer(conf, h)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return e, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialTestServer 會連線到測試伺服器。
+func dialTestServer(t testing.TB, addr string) *Client {
+	c, _, err := NewClient(&ClientConfig{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	const total = 200
+	var (
+		e       *Engine
+		ch      *Channel
+		connect sync.WaitGroup
+	)
+	connect.Add(total)
+	e, addr := newTestServer(t, DefaultConfig(), &testHandler{
+		connect: func(s *Session) {
+			s.Set("id", s.ID())
+			if err := s.Subscribe("room"); err != nil {
+				t.Error(err)
+			}
+			connect.Done()
+		},
+		message: func(s *Session, msg string) {
+			s.Set("last", msg)
+			_ = s.GetString("last")
+			ch.BroadcastOthers(msg, s)
+			e.BroadcastFilter(msg, func(v *Session) bool {
+				_, ok := v.Get("id")
+				return ok
+			})
+			s.IsSubscribed("room")
+			e.Len()
+			ch.Len()
+		},
+	})
+	ch, _ = e.NewChannel("room", nil)
+
+	var clients sync.WaitGroup
+	for i := 0; i < total; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			c, _, err := NewClient(&ClientConfig{Address: addr})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go func() {
+				for {
+					if _, err := c.Read(); err != nil {
+						return
+					}
+				}
+			}()
+			for j := 0; j < 5; j++ {
+				if err := c.Write("hello"); err != nil {
+					t.Error(err)
+				}
+			}
+			connect.Wait()
+			c.Close()
+		}()
+	}
+	connect.Wait()
+	for _, s := range ch.Sessions() {
+		go s.UnsubscribeAll()
+	}
+	e.Broadcast("bye")
+	ch.Close()
+	clients.Wait()
+	e.Close()
+}
+
+func TestSessionConcurrentWrites(t *testing.T) {
+	const writers, each = 20, 50
+	conf := DefaultConfig()
+	conf.SendQueueSize = writers * each
+	e, addr := newTestServer(t, conf, &testHandler{
+		connect: func(s *Session) {
+			for i := 0; i < writers; i++ {
+				go func() {
+					for j := 0; j < each; j++ {
+						if err := s.Write("hello"); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+		},
+	})
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+	for i := 0; i < writers*each; i++ {
+		if _, err := c.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteBinaryCopy(t *testing.T) {
+	e := NewServer(DefaultConfig(), nil)
+	ch, _ := e.NewChannel("room", nil)
+	s := e.NewSession(nil)
+	s.Subscribe("room")
+
+	// 訊息是非同步地被寫入，呼叫者在回傳後重新使用切片不應該影響佇列中的訊息。
+	buf := []byte("first")
+	s.WriteBinary(buf)
+	copy(buf, "xxxxx")
+	e.BroadcastBinary(buf)
+	copy(buf, "yyyyy")
+	ch.BroadcastBinary(buf)
+	copy(buf, "zzzzz")
+	for _, expected := range []string{"first", "xxxxx", "yyyyy"} {
+		if m := <-s.send; string(m.data) != expected {
+			t.Fatalf("expected %q, got %q", expected, m.data)
+		}
+	}
+}
+
+func TestSessionSendQueueFull(t *testing.T) {
+	e := NewServer(&EngineConfig{SendQueueSize: 2}, &testHandler{})
+	s := e.NewSession(nil)
+	for i := 0; i < 2; i++ {
+		if err := s.Write("hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.WriteBinary([]byte("hello")); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	s.Close()
+	if err := s.Write("hello"); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestSessionOverflowPolicy(t *testing.T) {
+	newSession := func(policy OverflowPolicy) (*Engine, *Session) {
+		e := NewServer(&EngineConfig{
+			SendQueueSize:   1,
+			OverflowPolicy:  policy,
+			OverflowTimeout: 10 * time.Millisecond,
+		}, &testHandler{})
+		s := e.NewSession(nil)
+		if err := s.Write("first"); err != nil {
+			t.Fatal(err)
+		}
+		return e, s
+	}
+
+	e, s := newSession(OverflowDropNewest)
+	if err := s.Write("second"); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	if m := <-s.send; string(m.data) != "first" {
+		t.Fatalf("expected the oldest message to be kept, got %s", m.data)
+	}
+
+	e, s = newSession(OverflowDropOldest)
+	if err := s.Write("second"); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-s.send; string(m.data) != "second" {
+		t.Fatalf("expected the newest message to be kept, got %s", m.data)
+	}
+
+	e, s = newSession(OverflowBlock)
+	if err := s.Write("second"); err != ErrWriteTimedOut {
+		t.Fatalf("expected ErrWriteTimedOut, got %v", err)
+	}
+
+	// 沒有設置任何等待時間時，應該要一直等到佇列有空間為止。
+	e = NewServer(&EngineConfig{SendQueueSize: 1, OverflowPolicy: OverflowBlock}, &testHandler{})
+	blocked := e.NewSession(nil)
+	blocked.Write("first")
+	written := make(chan error, 1)
+	go func() {
+		written <- blocked.Write("second")
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("expected the write to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-blocked.send
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	e, s = newSession(OverflowDisconnect)
+	if err := s.Write("second"); err != ErrSendQueueFull {
+		t.Fatalf("expected ErrSendQueueFull, got %v", err)
+	}
+	if !s.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+	if s.Dropped() != 2 || e.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped messages, got %d and %d", s.Dropped(), e.Dropped())
+	}
+}
+
+func TestChannelOverflowPolicy(t *testing.T) {
+	e := NewServer(&EngineConfig{SendQueueSize: 1}, &testHandler{})
+	ch, _ := e.NewChannel("room", &ChannelConfig{OverflowPolicy: OverflowDropOldest})
+	s := e.NewSession(nil)
+	if err := s.Subscribe("room"); err != nil {
+		t.Fatal(err)
+	}
+	ch.Broadcast("first")
+	ch.Broadcast("second")
+	if m := <-s.send; string(m.data) != "second" {
+		t.Fatalf("expected the newest message to be kept, got %s", m.data)
+	}
+	if s.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", s.Dropped())
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	conf := DefaultConfig()
+	conf.PongWait = 200 * time.Millisecond
+	conf.PingPeriod = 50 * time.Millisecond
+	// 沒有設置 `WriteWait` 時寫入不應該有期限，Ping 也不應該因此逾時。
+	confs := map[string]*EngineConfig{
+		"default":      conf,
+		"no-writewait": {PongWait: 200 * time.Millisecond, PingPeriod: 50 * time.Millisecond},
+	}
+	for name, conf := range confs {
+		t.Run(name, func(t *testing.T) {
+			errs := make(chan error, 2)
+			closes := make(chan CloseStatus, 2)
+			disconnects := make(chan *Session, 2)
+			e, addr := newTestServer(t, conf, &testHandler{
+				err: func(s *Session, err error) {
+					errs <- err
+				},
+				close: func(s *Session, status CloseStatus, msg string) {
+					closes <- status
+				},
+				disconnect: func(s *Session) {
+					disconnects <- s
+				},
+			})
+			defer e.Close()
+
+			// 持續讀取的客戶端會自動回應 Ping，所以不應該被中斷。
+			alive := dialTestServer(t, addr)
+			defer alive.Close()
+			go func() {
+				for {
+					if _, _, err := alive.ReadAll(); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case err := <-errs:
+				t.Fatalf("expected the responsive client to stay connected, got %v", err)
+			case <-disconnects:
+				t.Fatalf("expected the responsive client to stay connected")
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			// 不讀取的客戶端無法回應 Ping，應該在 PongWait 之後被中斷。
+			dead := dialTestServer(t, addr)
+			defer dead.Close()
+			select {
+			case err := <-errs:
+				if err != ErrSessionTimedOut {
+					t.Fatalf("expected ErrSessionTimedOut, got %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected the unresponsive client to time out")
+			}
+			if status := <-closes; status != CloseAbnormalClosure {
+				t.Fatalf("expected CloseAbnormalClosure, got %d", status)
+			}
+		})
+	}
+}
+
+func TestSessionTeardown(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		disconnects = make(map[string]int)
+		connected   = make(chan *Session, 4)
+		gone        = make(chan *Session, 4)
+	)
+	e, addr := newTestServer(t, DefaultConfig(), &testHandler{
+		connect: func(s *Session) {
+			if err := s.Subscribe("room"); err != nil {
+				t.Error(err)
+			}
+			connected <- s
+		},
+		disconnect: func(s *Session) {
+			mu.Lock()
+			disconnects[s.ID()]++
+			mu.Unlock()
+			gone <- s
+		},
+	})
+	ch, _ := e.NewChannel("room", nil)
+
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = dialTestServer(t, addr)
+		<-connected
+	}
+	// 客戶端正常關閉、客戶端中斷連線、伺服器關閉階段、引擎關閉。
+	clients[0].Disconnect()
+	<-gone
+	clients[1].Close()
+	<-gone
+	for _, s := range ch.Sessions() {
+		s.Close()
+		break
+	}
+	<-gone
+	e.Close()
+	<-gone
+
+	if e.Len() != 0 {
+		t.Fatalf("expected no sessions left in the engine, got %d", e.Len())
+	}
+	if ch.Len() != 0 {
+		t.Fatalf("expected no sessions left in the channel, got %d", ch.Len())
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(disconnects) != 4 {
+		t.Fatalf("expected 4 disconnected sessions, got %d", len(disconnects))
+	}
+	for id, n := range disconnects {
+		if n != 1 {
+			t.Fatalf("expected session %s to disconnect once, got %d", id, n)
+		}
+	}
+}
+
+func TestEngineShutdown(t *testing.T) {
+	connected := make(chan *Session, 3)
+	e, addr := newTestServer(t, DefaultConfig(), &testHandler{
+		connect: func(s *Session) {
+			connected <- s
+		},
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		c := dialTestServer(t, addr)
+		(<-connected).Write("bye")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if msg, err := c.Read(); err != nil || msg != "bye" {
+				t.Errorf("expected the queued message to be flushed, got %q, %v", msg, err)
+			}
+			if _, err := c.Read(); !websocket.IsCloseError(err, int(CloseGoingAway)) {
+				t.Errorf("expected a going away close frame, got %v", err)
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e.Len() != 0 {
+		t.Fatalf("expected no sessions left in the engine, got %d", e.Len())
+	}
+	wg.Wait()
+	_, resp, err := NewClient(&ClientConfig{Address: addr})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected new connections to be refused with 503, got %v", err)
+	}
+}
+
+func TestEngineShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{})
+	e, addr := newTestServer(t, DefaultConfig(), &testHandler{
+		message: func(s *Session, msg string) {
+			close(received)
+			<-release
+		},
+	})
+	defer close(release)
+	c := dialTestServer(t, addr)
+	defer c.Close()
+	c.Write("block")
+	<-received
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestEngineShutdownUpgrading(t *testing.T) {
+	admitted := make(chan struct{})
+	release := make(chan struct{})
+	e, addr := newTestServer(t, DefaultConfig(), &HandlerFuncs{
+		OnAdmit: func(r *http.Request) *Admission {
+			close(admitted)
+			<-release
+			return nil
+		},
+	})
+	dialed := make(chan *Client, 1)
+	go func() {
+		c, _, err := NewClient(&ClientConfig{Address: addr})
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- c
+	}()
+	<-admitted
+
+	// 在關閉引擎之前就已經通過准入的連線，即使在關閉之後才完成升級也應該要接收到關閉訊息。
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- e.ShutdownWithStatus(ctx, CloseServiceRestart, "restarting")
+	}()
+	for !e.IsClosed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	c := <-dialed
+	if c == nil {
+		t.FailNow()
+	}
+	defer c.Close()
+	if _, err := c.Read(); !websocket.IsCloseError(err, int(CloseServiceRestart)) {
+		t.Fatalf("expected a service restart close frame, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Shutdown to return once the late session was closed")
+	}
+}
+
+func TestSessionCloseWithStatus(t *testing.T) {
+	conf := DefaultConfig()
+	conf.CloseTimeout = 10 * time.Second
+	e, addr := newTestServer(t, conf, &testHandler{
+		connect: func(s *Session) {
+			s.Subscribe("room")
+		},
+		message: func(s *Session, msg string) {
+			s.CloseWithStatus(ClosePolicyViolation, "kicked")
+		},
+	})
+	ch, _ := e.NewChannel("room", nil)
+	defer e.Close()
+
+	kicked := dialTestServer(t, addr)
+	defer kicked.Close()
+	kicked.Write("kick")
+	_, err := kicked.Read()
+	if !websocket.IsCloseError(err, int(ClosePolicyViolation)) || err.(*websocket.CloseError).Text != "kicked" {
+		t.Fatalf("expected a policy violation close frame, got %v", err)
+	}
+	// 客戶端回應關閉訊息後，伺服器不應該等待到 CloseTimeout 才結束寫入迴圈並中斷連線。
+	gone := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(gone)
+	}()
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the close handshake to complete")
+	}
+
+	restarted := dialTestServer(t, addr)
+	defer restarted.Close()
+	for ch.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ch.CloseWithStatus(CloseServiceRestart, "restarting")
+	if _, err := restarted.Read(); !websocket.IsCloseError(err, int(CloseServiceRestart)) {
+		t.Fatalf("expected a service restart close frame, got %v", err)
+	}
+
+	// 沒有設置 `WriteWait` 時也應該要能送出關閉訊息。
+	e2, addr2 := newTestServer(t, &EngineConfig{}, &testHandler{
+		message: func(s *Session, msg string) {
+			s.CloseWithStatus(ClosePolicyViolation, "kicked")
+		},
+	})
+	defer e2.Close()
+	c := dialTestServer(t, addr2)
+	defer c.Close()
+	c.Write("kick")
+	if _, err := c.Read(); !websocket.IsCloseError(err, int(ClosePolicyViolation)) {
+		t.Fatalf("expected a policy violation close frame, got %v", err)
+	}
+}
+
+// upgradeErrorHandler 是同時實作了 `UpgradeErrorHandler` 的測試處理函式。
+type upgradeErrorHandler struct {
+	testHandler
+	errs chan error
+}
+
+func (h *upgradeErrorHandler) UpgradeError(r *http.Request, err error) {
+	if r.URL.Path != "/ws" {
+		panic("unexpected request")
+	}
+	h.errs <- err
+}
+
+func TestEngineUpgradeError(t *testing.T) {
+	h := &upgradeErrorHandler{errs: make(chan error, 1)}
+	e := NewServer(DefaultConfig(), h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 response, got %d", resp.StatusCode)
+	}
+	if err := <-h.errs; err == nil {
+		t.Fatal("expected an upgrade error")
+	}
+	if e.Len() != 0 {
+		t.Fatalf("expected no sessions to be created, got %d", e.Len())
+	}
+}
+
+// admitHandler 是同時實作了 `Admitter` 的測試處理函式，只准許帶有 `token` 參數的連線。
+type admitHandler struct {
+	testHandler
+}
+
+func (h *admitHandler) Admit(r *http.Request) *Admission {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return &Admission{
+			Status: http.StatusUnauthorized,
+			Header: http.Header{"Www-Authenticate": {"Bearer"}},
+		}
+	}
+	return &Admission{
+		Header:      http.Header{"X-User": {token}},
+		Subprotocol: "chat.v2",
+		Store:       map[string]interface{}{"user": token},
+	}
+}
+
+func TestEngineAdmit(t *testing.T) {
+	users := make(chan string, 1)
+	h := &admitHandler{testHandler{
+		connect: func(s *Session) {
+			users <- s.GetString("user")
+		},
+	}}
+	e, addr := newTestServer(t, DefaultConfig(), h)
+	defer e.Close()
+
+	_, resp, err := NewClient(&ClientConfig{Address: addr})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Www-Authenticate") != "Bearer" {
+		t.Fatalf("expected the connection to be refused with 401, got %v", err)
+	}
+
+	c, resp, err := NewClient(&ClientConfig{
+		Address: addr + "?token=alice",
+		Header:  http.Header{"Sec-WebSocket-Protocol": {"chat.v1, chat.v2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if resp.Header.Get("X-User") != "alice" || resp.Header.Get("Sec-WebSocket-Protocol") != "chat.v2" {
+		t.Fatalf("expected the admission headers to be sent, got %v", resp.Header)
+	}
+	if user := <-users; user != "alice" {
+		t.Fatalf("expected the session store to be seeded before Connect, got %q", user)
+	}
+}
+
+func TestSessionHandshake(t *testing.T) {
+	handshakes := make(chan *Handshake, 1)
+	conf := DefaultConfig()
+	conf.Upgrader.Subprotocols = []string{"chat.v2"}
+	e, addr := newTestServer(t, conf, &testHandler{
+		connect: func(s *Session) {
+			handshakes <- s.Handshake()
+		},
+	})
+	defer e.Close()
+	c, _, err := NewClient(&ClientConfig{
+		Address: addr + "/room?tenant=acme",
+		Header: http.Header{
+			"X-Trace":                {"abc"},
+			"Cookie":                 {"sid=123"},
+			"Sec-WebSocket-Protocol": {"chat.v2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := <-handshakes
+	if h.Query().Get("tenant") != "acme" || h.URL().Path != "/room" {
+		t.Fatalf("unexpected handshake url: %s", h.URL())
+	}
+	if h.Header().Get("X-Trace") != "abc" {
+		t.Fatalf("unexpected handshake header: %v", h.Header())
+	}
+	if cookie, err := h.Cookie("sid"); err != nil || cookie.Value != "123" {
+		t.Fatalf("unexpected handshake cookie: %v, %v", cookie, err)
+	}
+	if h.Subprotocol() != "chat.v2" || h.TLS() != nil || !strings.HasPrefix(h.RemoteAddr(), "127.0.0.1:") {
+		t.Fatalf("unexpected handshake: %s, %v, %s", h.Subprotocol(), h.TLS(), h.RemoteAddr())
+	}
+	h.Header().Set("X-Trace", "changed")
+	if h.Header().Get("X-Trace") != "abc" {
+		t.Fatal("expected the handshake header to be read-only")
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	connected := make(chan *Session, 1)
+	e, addr := newTestServer(t, DefaultConfig(), &testHandler{
+		connect: func(s *Session) {
+			connected <- s
+		},
+	})
+	defer e.Close()
+	causeOf := func(s *Session) error {
+		select {
+		case <-s.Context().Done():
+			return context.Cause(s.Context())
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the session context to be cancelled")
+			return nil
+		}
+	}
+
+	c := dialTestServer(t, addr)
+	s := <-connected
+	if s.Context().Err() != nil {
+		t.Fatal("expected the session context to be alive")
+	}
+	s.CloseWithStatus(ClosePolicyViolation, "kicked")
+	if err, ok := causeOf(s).(*CloseError); !ok || err.Status != ClosePolicyViolation || err.Reason != "kicked" {
+		t.Fatalf("expected a policy violation cause, got %v", err)
+	}
+	c.Close()
+
+	c = dialTestServer(t, addr)
+	s = <-connected
+	c.DisconnectWithMsg("bye")
+	if err, ok := causeOf(s).(*CloseError); !ok || err.Status != CloseNormalClosure || err.Reason != "bye" {
+		t.Fatalf("expected a normal closure cause, got %v", err)
+	}
+	c.Close()
+
+	c = dialTestServer(t, addr)
+	s = <-connected
+	c.Close()
+	if err := causeOf(s); err == nil || err == context.Canceled {
+		t.Fatalf("expected the read error as the cause, got %v", err)
+	}
+}
+
+// echoHandler 是只實作了 `Messager` 的最小處理函式。
+type echoHandler struct{}
+
+func (echoHandler) Message(s *Session, msg string) {
+	s.Write(msg)
+}
+
+func TestMinimalHandler(t *testing.T) {
+	e, addr := newTestServer(t, DefaultConfig(), echoHandler{})
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+	c.Write("hello")
+	if msg, err := c.Read(); err != nil || msg != "hello" {
+		t.Fatalf("expected the message to be echoed, got %q, %v", msg, err)
+	}
+}
+
+func TestHandlerFuncs(t *testing.T) {
+	disconnected := make(chan struct{})
+	e, addr := newTestServer(t, DefaultConfig(), &HandlerFuncs{
+		OnConnect: func(s *Session) {
+			s.Write("welcome")
+		},
+		OnDisconnect: func(s *Session) {
+			close(disconnected)
+		},
+	})
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	if msg, err := c.Read(); err != nil || msg != "welcome" {
+		t.Fatalf("expected a welcome message, got %q, %v", msg, err)
+	}
+	c.Write("ignored")
+	c.Disconnect()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected OnDisconnect to be called")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	errs := make(chan error, 1)
+	router := NewRouter(&HandlerFuncs{
+		OnError: func(s *Session, err error) {
+			errs <- err
+		},
+	})
+	router.On("chat.send", func(s *Session, data json.RawMessage) {
+		var msg struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Error(err)
+		}
+		s.Emit("chat.receive", map[string]string{"text": msg.Text})
+	})
+	router.On("echo", func(s *Session, data json.RawMessage) {
+		var msg string
+		json.Unmarshal(data, &msg)
+		s.Write(msg)
+	})
+	router.Fallback(func(s *Session, ev *Event) {
+		s.Emit("unknown", ev.Event)
+	})
+	e, addr := newTestServer(t, DefaultConfig(), router)
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	c.Write(`{"event": "chat.send", "data": {"text": "hello"}}`)
+	if msg, err := c.Read(); err != nil || msg != `{"event":"chat.receive","data":{"text":"hello"}}` {
+		t.Fatalf("unexpected reply: %s, %v", msg, err)
+	}
+	// 帶有 `id` 但沒有以 `Handle` 註冊方法的事件仍然是一般的事件。
+	c.Write(`{"event": "chat.send", "id": "client-msg-1", "data": {"text": "again"}}`)
+	if msg, err := c.Read(); err != nil || msg != `{"event":"chat.receive","data":{"text":"again"}}` {
+		t.Fatalf("unexpected reply: %s, %v", msg, err)
+	}
+	// 客戶端註冊了方法之後，不是遠端呼叫也不是回應的訊息仍然要能夠被讀取。
+	c.Handle("noop", func(params json.RawMessage) (interface{}, error) {
+		return nil, nil
+	})
+	for _, expected := range []string{`{"id":"42","name":"widget"}`, `{"event":"order.created","id":"7"}`} {
+		data, _ := json.Marshal(expected)
+		c.Write(`{"event": "echo", "data": ` + string(data) + `}`)
+		if msg, err := c.Read(); err != nil || msg != expected {
+			t.Fatalf("expected %s to be read, got %s, %v", expected, msg, err)
+		}
+	}
+	c.Write(`{"event": "chat.typing"}`)
+	if msg, err := c.Read(); err != nil || msg != `{"event":"unknown","data":"chat.typing"}` {
+		t.Fatalf("unexpected fallback reply: %s, %v", msg, err)
+	}
+	c.Write(`not json`)
+	if err := <-errs; !errors.Is(err, ErrEventMalformed) {
+		t.Fatalf("expected ErrEventMalformed, got %v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	connected := make(chan *Session, 1)
+	router := NewRouter(&HandlerFuncs{
+		OnConnect: func(s *Session) {
+			connected <- s
+		},
+	})
+	router.Handle("sum", func(s *Session, params json.RawMessage) (interface{}, error) {
+		var nums []int
+		if err := json.Unmarshal(params, &nums); err != nil {
+			return nil, err
+		}
+		// 處理函式中也能夠反過來呼叫客戶端。
+		result, err := s.Call(context.Background(), "offset", nil)
+		if err != nil {
+			return nil, err
+		}
+		var offset int
+		json.Unmarshal(result, &offset)
+		return nums[0] + nums[1] + offset, nil
+	})
+	router.Handle("fail", func(s *Session, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	router.Handle("hang", func(s *Session, params json.RawMessage) (interface{}, error) {
+		<-s.Context().Done()
+		return nil, nil
+	})
+	e, addr := newTestServer(t, DefaultConfig(), router)
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+	c.Handle("offset", func(params json.RawMessage) (interface{}, error) {
+		return 10, nil
+	})
+	c.Handle("slow", func(params json.RawMessage) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	go func() {
+		for {
+			if _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	s := <-connected
+
+	result, err := c.Call(context.Background(), "sum", []int{1, 2})
+	if err != nil || string(result) != "13" {
+		t.Fatalf("expected 13, got %s, %v", result, err)
+	}
+	if _, err := c.Call(context.Background(), "fail", nil); err == nil || err.(*CallError).Message != "failed" {
+		t.Fatalf("expected a call error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Call(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Call(context.Background(), "slow", nil)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	if err := <-errs; err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+
+	// 伺服器直接中斷連線時，客戶端等待中的遠端呼叫也應該要結束。
+	c = dialTestServer(t, addr)
+	defer c.Close()
+	go func() {
+		for {
+			if _, err := c.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	s = <-connected
+	go func() {
+		_, err := c.Call(context.Background(), "hang", nil)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.conn.Close()
+	select {
+	case err := <-errs:
+		if err != ErrConnectionClosed {
+			t.Fatalf("expected ErrConnectionClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the pending call to fail once the server dropped the connection")
+	}
+	if !c.IsClosed() {
+		t.Fatal("expected the client to be closed")
+	}
+
+	// 沒有使用 `Router` 時客戶端的回應無法被處理，應該直接回傳錯誤而不是等待。
+	if _, err := NewServer(DefaultConfig(), nil).NewSession(nil).Call(context.Background(), "offset", nil); err != ErrRouterRequired {
+		t.Fatalf("expected ErrRouterRequired, got %v", err)
+	}
+}
+
+// newJSONRPCTestServer 會建立帶有 JSON-RPC 2.0 規範範例方法的測試伺服器。
+func newJSONRPCTestServer(t testing.TB, h interface{}) (*Engine, string, chan string) {
+	notified := make(chan string, 16)
+	rpc := NewJSONRPC(h)
+	rpc.Handle("subtract", func(s *Session, params json.RawMessage) (interface{}, error) {
+		var nums []int
+		if err := json.Unmarshal(params, &nums); err == nil && len(nums) == 2 {
+			return nums[0] - nums[1], nil
+		}
+		var named struct {
+			Minuend    *int `json:"minuend"`
+			Subtrahend *int `json:"subtrahend"`
+		}
+		if err := json.Unmarshal(params, &named); err != nil || named.Minuend == nil || named.Subtrahend == nil {
+			return nil, NewJSONRPCError(JSONRPCInvalidParams)
+		}
+		return *named.Minuend - *named.Subtrahend, nil
+	})
+	rpc.Handle("sum", func(s *Session, params json.RawMessage) (interface{}, error) {
+		var nums []int
+		if err := json.Unmarshal(params, &nums); err != nil {
+			return nil, NewJSONRPCError(JSONRPCInvalidParams)
+		}
+		var sum int
+		for _, v := range nums {
+			sum += v
+		}
+		return sum, nil
+	})
+	rpc.Handle("get_data", func(s *Session, params json.RawMessage) (interface{}, error) {
+		return []interface{}{"hello", 5}, nil
+	})
+	rpc.Handle("fail", func(s *Session, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	for _, v := range []string{"update", "notify_hello", "notify_sum"} {
+		method := v
+		rpc.Handle(method, func(s *Session, params json.RawMessage) (interface{}, error) {
+			notified <- method
+			return nil, nil
+		})
+	}
+	e, addr := newTestServer(t, DefaultConfig(), rpc)
+	return e, addr, notified
+}
+
+func TestJSONRPC(t *testing.T) {
+	e, addr, notified := newJSONRPCTestServer(t, nil)
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	// 下列皆為 JSON-RPC 2.0 規範中的範例，沒有預期回應的是通知。
+	tests := []struct {
+		request  string
+		response string
+	}{
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`, `{"jsonrpc": "2.0", "result": 19, "id": 1}`},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": [23, 42], "id": 2}`, `{"jsonrpc": "2.0", "result": -19, "id": 2}`},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`, `{"jsonrpc": "2.0", "result": 19, "id": 3}`},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": {"minuend": 42, "subtrahend": 23}, "id": 4}`, `{"jsonrpc": "2.0", "result": 19, "id": 4}`},
+		{`{"jsonrpc": "2.0", "method": "update", "params": [1,2,3,4,5]}`, ``},
+		{`{"jsonrpc": "2.0", "method": "foobar"}`, ``},
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`, `{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "1"}`},
+		{`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`, `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+		{`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`, `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+		{`[
+  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+  {"jsonrpc": "2.0", "method"
+]`, `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`},
+		{`[]`, `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`},
+		{`[1]`, `[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}]`},
+		{`[1,2,3]`, `[
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}
+]`},
+		{`[
+  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},
+  {"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},
+  {"foo": "boo"},
+  {"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"},
+  {"jsonrpc": "2.0", "method": "get_data", "id": "9"}
+]`, `[
+  {"jsonrpc": "2.0", "result": 7, "id": "1"},
+  {"jsonrpc": "2.0", "result": 19, "id": "2"},
+  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+  {"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "5"},
+  {"jsonrpc": "2.0", "result": ["hello", 5], "id": "9"}
+]`},
+		{`[
+  {"jsonrpc": "2.0", "method": "notify_sum", "params": [1,2,4]},
+  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}
+]`, ``},
+		{`{"jsonrpc": "2.0", "method": "subtract", "params": {"minuend": 42}, "id": 5}`, `{"jsonrpc": "2.0", "error": {"code": -32602, "message": "Invalid params"}, "id": 5}`},
+		{`{"jsonrpc": "2.0", "method": "fail", "id": 6}`, `{"jsonrpc": "2.0", "error": {"code": -32000, "message": "failed"}, "id": 6}`},
+	}
+	for _, v := range tests {
+		if err := c.Write(v.request); err != nil {
+			t.Fatal(err)
+		}
+		if v.response == "" {
+			continue
+		}
+		msg, err := c.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, expected interface{}
+		if err := json.Unmarshal([]byte(msg), &got); err != nil {
+			t.Fatalf("unexpected response %s: %v", msg, err)
+		}
+		json.Unmarshal([]byte(v.response), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("request %s: expected %s, got %s", v.request, v.response, msg)
+		}
+	}
+	// 通知只會被執行，不會有任何回應。
+	for _, v := range []string{"update", "notify_hello", "notify_sum", "notify_hello"} {
+		if method := <-notified; method != v {
+			t.Fatalf("expected notification %s, got %s", v, method)
+		}
+	}
+}
+
+func TestJSONRPCSlowMethod(t *testing.T) {
+	errs := make(chan error, 1)
+	rpc := NewJSONRPC(&HandlerFuncs{
+		OnError: func(s *Session, err error) {
+			errs <- err
+		},
+	})
+	rpc.Handle("slow", func(s *Session, params json.RawMessage) (interface{}, error) {
+		time.Sleep(400 * time.Millisecond)
+		return "done", nil
+	})
+	conf := DefaultConfig()
+	conf.PongWait = 200 * time.Millisecond
+	conf.PingPeriod = 50 * time.Millisecond
+	e, addr := newTestServer(t, conf, rpc)
+	defer e.Close()
+	c := dialTestServer(t, addr)
+	defer c.Close()
+
+	// 執行時間超過 PongWait 的方法不應該阻塞讀取迴圈而導致連線逾時。
+	c.Write(`{"jsonrpc": "2.0", "method": "slow", "id": 1}`)
+	if msg, err := c.Read(); err != nil || msg != `{"jsonrpc":"2.0","result":"done","id":1}` {
+		t.Fatalf("unexpected response: %s, %v", msg, err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("expected the session to stay connected, got %v", err)
+	default:
+	}
+}
+
+func TestJSONRPCClient(t *testing.T) {
+	connected := make(chan *Session, 1)
+	e, addr, notified := newJSONRPCTestServer(t, &HandlerFuncs{
+		OnConnect: func(s *Session) {
+			connected <- s
+		},
+	})
+	defer e.Close()
+	c, _, err := NewJSONRPCClient(&ClientConfig{Address: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-connected
+
+	result, err := c.Call(context.Background(), "subtract", []int{42, 23})
+	if err != nil || string(result) != "19" {
+		t.Fatalf("expected 19, got %s, %v", result, err)
+	}
+	var rpcErr *JSONRPCError
+	if _, err := c.Call(context.Background(), "foobar", nil); !errors.As(err, &rpcErr) || rpcErr.Code != JSONRPCMethodNotFound {
+		t.Fatalf("expected a method not found error, got %v", err)
+	}
+
+	if err := c.Notify("update", []int{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if method := <-notified; method != "update" {
+		t.Fatalf("expected notification update, got %s", method)
+	}
+
+	calls := []*JSONRPCCall{
+		{Method: "sum", Params: []int{1, 2, 4}},
+		{Method: "notify_hello", Params: []int{7}, Notification: true},
+		{Method: "foo.get"},
+		{Method: "get_data"},
+	}
+	if err := c.Batch(context.Background(), calls...); err != nil {
+		t.Fatal(err)
+	}
+	if string(calls[0].Result) != "7" || calls[2].Error == nil || calls[2].Error.Code != JSONRPCMethodNotFound || string(calls[3].Result) != `["hello",5]` {
+		t.Fatalf("unexpected batch results %s, %v, %s", calls[0].Result, calls[2].Error, calls[3].Result)
+	}
+
+	// 伺服端也能夠主動傳送通知給客戶端。
+	received := make(chan string, 1)
+	c.OnNotification("progress", func(params json.RawMessage) {
+		received <- string(params)
+	})
+	if err := s.Notify("progress", []int{50}); err != nil {
+		t.Fatal(err)
+	}
+	if params := <-received; params != "[50]" {
+		t.Fatalf("expected [50], got %s", params)
+	}
+
+	s.Close()
+	<-c.done
+	if _, err := c.Call(context.Background(), "sum", []int{1}); err != ErrConnectionClosed {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+// prefixCodec 是以二進制訊息傳送帶有前綴的 JSON 的測試編碼方式，由於含有切片所以是無法比較的型態。
+type prefixCodec struct {
+	prefix []byte
+}
+
+func (c prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return append(append([]byte{}, c.prefix...), data...), err
+}
+
+func (c prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(bytes.TrimPrefix(data, c.prefix), v)
+}
+
+func (c prefixCodec) MessageType() MessageType {
+	return BinaryMessage
+}
+
+func TestCodec(t *testing.T) {
+	type point struct {
+		X    int    `json:"x"`
+		Name string `json:"name"`
+	}
+	prefixed := prefixCodec{prefix: []byte("junipero:")}
+	connected := make(chan *Session, 3)
+	received := make(chan point, 3)
+	conf := DefaultConfig()
+	conf.Codecs = map[string]Codec{"prefixed": prefixed}
+	e, addr := newTestServer(t, conf, &HandlerFuncs{
+		OnConnect: func(s *Session) {
+			connected <- s
+		},
+		OnMessageBinary: func(s *Session, msg []byte) {
+			var p point
+			if err := s.Codec().Unmarshal(msg, &p); err != nil {
+				t.Error(err)
+			}
+			received <- p
+		},
+	})
+	defer e.Close()
+
+	clients := make(map[string]*Client)
+	for _, v := range []struct {
+		name  string
+		codec Codec
+	}{{"", JSONCodec}, {"prefixed", prefixed}} {
+		conf := &ClientConfig{Address: addr}
+		if v.name != "" {
+			conf.Codecs = map[string]Codec{v.name: v.codec}
+		}
+		c, _, err := NewClient(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if s := <-connected; !reflect.DeepEqual(s.Codec(), v.codec) || !reflect.DeepEqual(c.Codec(), v.codec) {
+			t.Fatalf("expected codec %T for subprotocol %q, got %T and %T", v.codec, v.name, s.Codec(), c.Codec())
+		}
+		clients[v.name] = c
+	}
+
+	expected := point{X: 1, Name: "junipero"}
+	if err := e.BroadcastValue(expected); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range clients {
+		var p point
+		if err := c.ReadValue(&p); err != nil || p != expected {
+			t.Fatalf("expected %v from %q, got %v, %v", expected, name, p, err)
+		}
+	}
+	if err := clients["prefixed"].WriteValue(expected); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-received; p != expected {
+		t.Fatalf("expected %v, got %v", expected, p)
+	}
+
+}
+
+// newBroadcastBenchmark 會建立帶有指定數量客戶端的測試伺服器，
+// 回傳的通道會在每個客戶端接收到一則訊息時被傳入一次。
+func newBroadcastBenchmark(b *testing.B, n int, compress bool) (*Engine, []*Session, chan struct{}) {
+	connected := make(chan *Session, n)
+	conf := DefaultConfig()
+	conf.Upgrader.EnableCompression = compress
+	e, addr := newTestServer(b, conf, &HandlerFuncs{
+		OnConnect: func(s *Session) {
+			connected <- s
+		},
+	})
+	b.Cleanup(e.Close)
+	received := make(chan struct{}, n)
+	dialer := &websocket.Dialer{EnableCompression: compress}
+	sessions := make([]*Session, 0, n)
+	for i := 0; i < n; i++ {
+		c, _, err := dialer.Dial(addr, nil)
+		if err != nil {
+			b.Skipf("unable to open %d connections: %v", n, err)
+		}
+		b.Cleanup(func() { c.Close() })
+		go func() {
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+				received <- struct{}{}
+			}
+		}()
+		sessions = append(sessions, <-connected)
+	}
+	return e, sessions, received
+}
+
+// BenchmarkBroadcast 會比較逐一寫入各個客戶端與以預先編碼的訊框廣播的效能。
+func BenchmarkBroadcast(b *testing.B) {
+	msg := strings.Repeat("junipero ", 128)
+	for _, n := range []int{1000, 10000} {
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("sessions=%d/compress=%t", n, compress), func(b *testing.B) {
+				e, sessions, received := newBroadcastBenchmark(b, n, compress)
+				wait := func() {
+					for range sessions {
+						<-received
+					}
+				}
+				b.Run("write", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						for _, v := range sessions {
+							v.Write(msg)
+						}
+						wait()
+					}
+				})
+				b.Run("prepared", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						e.Broadcast(msg)
+						wait()
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestBroadcastReport(t *testing.T) {
+	conf := DefaultConfig()
+	conf.SendQueueSize = 1
+	e := NewServer(conf, nil)
+	// 沒有連線的階段不會有寫入迴圈，因此寫入佇列不會被消化。
+	a, b := e.NewSession(nil), e.NewSession(nil)
+	if r := e.BroadcastWithReport("first"); r.Delivered != 2 || r.Dropped != 0 || len(r.Failed) != 0 {
+		t.Fatalf("expected 2 delivered, got %+v", r)
+	}
+	b.Close()
+	r := e.BroadcastMultipleWithReport("second", []*Session{a, b})
+	if r.Delivered != 0 || r.Dropped != 1 || r.Failed[b] != ErrSessionClosed {
+		t.Fatalf("expected 1 dropped and 1 failed, got %+v", r)
+	}
+
+	ch, _ := e.NewChannel("news", nil)
+	c := e.NewSession(nil)
+	c.Subscribe("news")
+	if r, err := ch.BroadcastWithReport("first"); err != nil || r.Delivered != 1 {
+		t.Fatalf("expected 1 delivered, got %+v, %v", r, err)
+	}
+	conf.CloseOnBroadcastFailure = true
+	if r, err := ch.BroadcastWithReport("second"); err != nil || r.Dropped != 1 {
+		t.Fatalf("expected 1 dropped, got %+v, %v", r, err)
+	}
+	if !c.IsClosed() || a.IsClosed() {
+		t.Fatalf("expected only the dropped session to be closed")
+	}
+	ch.Close()
+	if err := ch.Broadcast("third"); err != ErrChannelClosed {
+		t.Fatalf("expected ErrChannelClosed, got %v", err)
+	}
+}
+
+func TestBroadcastFanOut(t *testing.T) {
+	conf := DefaultConfig()
+	conf.SendQueueSize = 1
+	conf.BroadcastWorkers = 4
+	conf.BroadcastBatchSize = 3
+	e := NewServer(conf, nil)
+	ch, _ := e.NewChannel("news", nil)
+	sessions := make([]*Session, 10)
+	for i := range sessions {
+		sessions[i] = e.NewSession(nil)
+		sessions[i].Subscribe("news")
+	}
+	if r := e.BroadcastWithReport("first"); r.Delivered != 10 {
+		t.Fatalf("expected 10 delivered, got %+v", r)
+	}
+	if r, err := ch.BroadcastWithReport("second"); err != nil || r.Dropped != 10 {
+		t.Fatalf("expected 10 dropped, got %+v, %v", r, err)
+	}
+	for _, v := range sessions {
+		<-v.send
+	}
+	sessions[0].Close()
+	if r := e.BroadcastMultipleWithReport("third", sessions); r.Delivered != 9 || r.Failed[sessions[0]] != ErrSessionClosed {
+		t.Fatalf("expected 9 delivered and 1 failed, got %+v", r)
+	}
+}
+
+// BenchmarkBroadcastFanOut 會比較依序寫入與平行寫入不同數量客戶端的廣播延遲與吞吐量。
+func BenchmarkBroadcastFanOut(b *testing.B) {
+	for _, n := range []int{1000, 10000, 50000} {
+		for _, workers := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("sessions=%d/workers=%d", n, workers), func(b *testing.B) {
+				conf := DefaultConfig()
+				conf.BroadcastWorkers = workers
+				e := NewServer(conf, nil)
+				// 沒有連線的階段不會有寫入迴圈，因此每次廣播後都需要手動清空寫入佇列。
+				sessions := make([]*Session, n)
+				for i := range sessions {
+					sessions[i] = e.NewSession(nil)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					e.Broadcast("junipero")
+					b.StopTimer()
+					for _, v := range sessions {
+						v.discard()
+					}
+					b.StartTimer()
+				}
+				b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "sessions/s")
+			})
+		}
+	}
+}
+
+// BenchmarkConnectChurn 會測量大量客戶端同時建立與關閉階段的效能。
+func BenchmarkConnectChurn(b *testing.B) {
+	for _, n := range []int{0, 100000} {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			e := NewServer(DefaultConfig(), nil)
+			for i := 0; i < n; i++ {
+				e.NewSession(nil)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					e.NewSession(nil).Close()
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSubscribeChurn 會測量大量客戶端同時訂閱與取消訂閱同一個頻道的效能。
+func BenchmarkSubscribeChurn(b *testing.B) {
+	const n = 100000
+	e := NewServer(DefaultConfig(), nil)
+	e.NewChannel("news", nil)
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		sessions[i] = e.NewSession(nil)
+	}
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s := sessions[atomic.AddUint64(&next, 1)%n]
+			if s.Subscribe("news") == nil {
+				s.Unsubscribe("news")
+			}
+		}
+	})
+}
+
+func TestSessionID(t *testing.T) {
+	e := NewServer(DefaultConfig(), nil)
+	ch, _ := e.NewChannel("room", nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		s := e.NewSession(nil)
+		if len(s.ID()) != 22 || strings.ContainsAny(s.ID(), "+/=") || seen[s.ID()] {
+			t.Fatalf("expected a unique url-safe id, got %q", s.ID())
+		}
+		seen[s.ID()] = true
+		s.Subscribe("room")
+		if ch.Sessions()[s.ID()] != s {
+			t.Fatalf("expected the channel to be keyed by %q", s.ID())
+		}
+	}
+
+	// 產生了重複的編號時會重新產生。
+	ids := []string{"a", "a", "b"}
+	conf := DefaultConfig()
+	conf.IDGenerator = func() string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	e = NewServer(conf, nil)
+	if a, b := e.NewSession(nil), e.NewSession(nil); a.ID() != "a" || b.ID() != "b" {
+		t.Fatalf("expected a and b, got %q and %q", a.ID(), b.ID())
+	}
+
+	// 持續產生重複的編號時應該要引發 panic 而不是無止盡地重試。
+	conf = DefaultConfig()
+	conf.IDGenerator = func() string {
+		return "same"
+	}
+	e = NewServer(conf, nil)
+	e.NewSession(nil)
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "IDGenerator") {
+			t.Fatalf("expected a panic about the IDGenerator, got %v", r)
+		}
+	}()
+	e.NewSession(nil)
+	t.Fatal("expected NewSession to panic")
+}
+
+func TestEngineSessions(t *testing.T) {
+	conf := DefaultConfig()
+	conf.IndexedKeys = []string{"user_id"}
+	e := NewServer(conf, nil)
+	a, b, c := e.NewSession(nil), e.NewSession(nil), e.NewSession(nil)
+	a.Set("user_id", 42)
+	b.Set("user_id", 42)
+	c.Set("user_id", 7)
+	c.Set("role", "admin")
+
+	if s, ok := e.Session(c.ID()); !ok || s != c {
+		t.Fatalf("expected to find session %s", c.ID())
+	}
+	if _, ok := e.Session("unknown"); ok {
+		t.Fatalf("expected no session")
+	}
+	if sessions := e.Sessions(); len(sessions) != 3 || sessions[a.ID()] != a {
+		t.Fatalf("expected 3 sessions, got %v", sessions)
+	}
+	var n int
+	e.Range(func(s *Session) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Fatalf("expected Range to stop after 2 sessions, got %d", n)
+	}
+
+	if sessions := e.Lookup("user_id", 42); len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions of user 42, got %d", len(sessions))
+	}
+	b.Set("user_id", 7)
+	a.Close()
+	if sessions := e.Lookup("user_id", 42); len(sessions) != 0 {
+		t.Fatalf("expected no sessions of user 42, got %d", len(sessions))
+	}
+	c.Delete("user_id")
+	if sessions := e.Lookup("user_id", 7); len(sessions) != 1 || sessions[0] != b {
+		t.Fatalf("expected only session %s of user 7, got %v", b.ID(), sessions)
+	}
+	// 沒有被索引的鍵名會逐一比對所有階段。
+	if sessions := e.Lookup("role", "admin"); len(sessions) != 1 || sessions[0] != c {
+		t.Fatalf("expected only session %s to be admin, got %v", c.ID(), sessions)
+	}
+	if sessions := e.Lookup("role", []string{"admin"}); len(sessions) != 0 {
+		t.Fatalf("expected no sessions for an incomparable value, got %v", sessions)
+	}
+}
+
+func TestUserBinding(t *testing.T) {
+	conf := DefaultConfig()
+	conf.SendQueueSize = 1
+	conf.MaxSessionsPerUser = 2
+	e := NewServer(conf, nil)
+	a, b, c := e.NewSession(nil), e.NewSession(nil), e.NewSession(nil)
+	if err := a.Bind("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Bind("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Bind("alice"); err != ErrUserSessionsExceeded {
+		t.Fatalf("expected ErrUserSessionsExceeded, got %v", err)
+	}
+	if err := c.Bind("bob"); err != nil || c.UserID() != "bob" {
+		t.Fatalf("expected to bind bob, got %q, %v", c.UserID(), err)
+	}
+	if sessions := e.UserSessions("alice"); len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions of alice, got %d", len(sessions))
+	}
+	if r := e.SendToUser("alice", "hello"); r.Delivered != 2 || len(c.send) != 0 {
+		t.Fatalf("expected only alice to receive the message, got %+v", r)
+	}
+
+	// 重新綁定與關閉的階段會自動解除原本的綁定。
+	if err := b.Bind("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.UserSessions("alice")) != 1 || len(e.UserSessions("bob")) != 2 {
+		t.Fatalf("expected 1 session of alice and 2 of bob")
+	}
+	a.Close()
+	if len(e.UserSessions("alice")) != 0 {
+		t.Fatalf("expected no sessions of alice")
+	}
+	if err := a.Bind("alice"); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+
+	e.DisconnectUser("bob", ClosePolicyViolation, "banned")
+	if !b.IsClosed() || !c.IsClosed() || len(e.UserSessions("bob")) != 0 {
+		t.Fatalf("expected all sessions of bob to be disconnected")
+	}
+}
+
+func TestEngineChannels(t *testing.T) {
+	e := NewServer(DefaultConfig(), nil)
+	ch, err := e.NewChannel("room", nil)
+	if err != nil || ch.Name() != "room" {
+		t.Fatalf("expected channel room, got %v", err)
+	}
+	if _, err := e.NewChannel("room", nil); err != ErrChannelExists {
+		t.Fatalf("expected ErrChannelExists, got %v", err)
+	}
+	if v, loaded := e.LoadOrNewChannel("room", nil); !loaded || v != ch {
+		t.Fatalf("expected to load the existing channel")
+	}
+	news, loaded := e.LoadOrNewChannel("news", nil)
+	if loaded {
+		t.Fatalf("expected to create a new channel")
+	}
+	if v, ok := e.Channel("news"); !ok || v != news {
+		t.Fatalf("expected to find channel news")
+	}
+	if channels := e.Channels(); len(channels) != 2 || channels["room"] != ch {
+		t.Fatalf("expected 2 channels, got %v", channels)
+	}
+
+	s := e.NewSession(nil)
+	if err := s.Subscribe("room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DeleteChannel("room"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Channel("room"); ok || !ch.IsClosed() || s.IsSubscribed("room") {
+		t.Fatalf("expected channel room to be closed and removed")
+	}
+	if err := e.DeleteChannel("room"); err != ErrChannelNotFound {
+		t.Fatalf("expected ErrChannelNotFound, got %v", err)
+	}
+	// 關閉的頻道名稱能夠再被使用。
+	news.Close()
+	if _, err := e.NewChannel("news", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChannelConfig(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	closed := make(chan *Channel, 1)
+	e := NewServer(DefaultConfig(), nil)
+	ch, _ := e.NewChannel("room", &ChannelConfig{
+		MaxSubscribers: 2,
+		AutoDelete:     true,
+		OnSubscribe: func(c *Channel, s *Session) {
+			record("subscribe " + s.GetString("name"))
+		},
+		OnUnsubscribe: func(c *Channel, s *Session) {
+			record("unsubscribe " + s.GetString("name"))
+		},
+		OnClose: func(c *Channel) {
+			record("close " + c.Name())
+			closed <- c
+		},
+	})
+	sessions := make([]*Session, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		sessions[i] = e.NewSession(nil)
+		sessions[i].Set("name", name)
+	}
+	a, b, c := sessions[0], sessions[1], sessions[2]
+	a.Subscribe("room")
+	b.Subscribe("room")
+	if err := c.Subscribe("room"); err != ErrChannelFull {
+		t.Fatalf("expected ErrChannelFull, got %v", err)
+	}
+	a.Unsubscribe("room")
+	if err := c.Subscribe("room"); err != nil {
+		t.Fatal(err)
+	}
+	// 最後一個訂閱者離開時頻道會被自動刪除。
+	b.Close()
+	c.Unsubscribe("room")
+	<-closed
+	if _, ok := e.Channel("room"); ok || !ch.IsClosed() {
+		t.Fatalf("expected channel room to be deleted")
+	}
+	expected := []string{"subscribe a", "subscribe b", "unsubscribe a", "subscribe c", "unsubscribe b", "unsubscribe c", "close room"}
+	mu.Lock()
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+	mu.Unlock()
+
+	// 閒置的頻道會在沒有訂閱者超過指定時間後被刪除，期間有訂閱者時則會重新計時。
+	idle, _ := e.NewChannel("idle", &ChannelConfig{
+		IdleTTL: 50 * time.Millisecond,
+		OnClose: func(c *Channel) {
+			closed <- c
+		},
+	})
+	d := e.NewSession(nil)
+	d.Subscribe("idle")
+	time.Sleep(100 * time.Millisecond)
+	if idle.IsClosed() {
+		t.Fatalf("expected channel with subscribers to stay open")
+	}
+	start := time.Now()
+	d.Unsubscribe("idle")
+	if <-closed != idle || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected channel idle to be deleted after its ttl")
+	}
+	if _, ok := e.Channel("idle"); ok {
+		t.Fatalf("expected channel idle to be deleted")
+	}
+}
+
+func TestChannelRecreate(t *testing.T) {
+	e := NewServer(DefaultConfig(), nil)
+	var (
+		a     = e.NewSession(nil)
+		b     = e.NewSession(nil)
+		fresh *Channel
+	)
+	// 在頻道關閉期間以同名重新建立並訂閱頻道，舊頻道的取消訂閱不應該移除新頻道的訂閱。
+	e.NewChannel("room", &ChannelConfig{
+		OnUnsubscribe: func(c *Channel, s *Session) {
+			fresh, _ = e.LoadOrNewChannel("room", nil)
+			a.Subscribe("room")
+			b.Subscribe("room")
+		},
+	})
+	a.Subscribe("room")
+	b.Subscribe("room")
+	e.DeleteChannel("room")
+	if fresh == nil || !fresh.Contains(a) || !fresh.Contains(b) {
+		t.Fatal("expected both sessions to be subscribed to the recreated channel")
+	}
+	a.Close()
+	b.Close()
+	if fresh.Contains(a) || fresh.Contains(b) || fresh.Len() != 0 {
+		t.Fatalf("expected closed sessions to leave the recreated channel, got %d subscribers", fresh.Len())
+	}
+}
@@ -0,0 +1,105 @@
+package junipero
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Event 是事件路由所使用的 JSON 信封格式，
+// 如：`{"event": "chat.send", "data": {"text": "Hello"}}`。
+//
+// 帶有 `id` 的事件是需要回應的遠端呼叫，而回應則只會帶有相同的 `id` 與 `data` 或 `error`，
+// 如：`{"event": "sum", "id": "1", "data": [1, 2]}` 與 `{"id": "1", "data": 3}`。
+type Event struct {
+	// Event 是事件名稱，在遠端呼叫中則是方法名稱。
+	Event string `json:"event,omitempty"`
+	// ID 是遠端呼叫的關聯編號。
+	ID string `json:"id,omitempty"`
+	// Data 是事件的原始 JSON 資料，在遠端呼叫的回應中則是呼叫結果。
+	Data json.RawMessage `json:"data,omitempty"`
+	// Error 是遠端呼叫失敗時的錯誤訊息。
+	Error string `json:"error,omitempty"`
+}
+
+// EventHandler 是處理指定事件的函式。
+type EventHandler func(*Session, json.RawMessage)
+
+// Router 是建立在處理函式之上的事件路由，會將接收到的文字訊息解析成 `Event` 並交由對應的函式處理，
+// 其他的事件則會交由原本的處理函式處理。路由本身就是一個處理函式，可以直接傳入 `NewServer`。
+type Router struct {
+	*HandlerFuncs
+
+	// mu 保護了下列的事件與方法處理函式。
+	mu       sync.RWMutex
+	events   map[string]EventHandler
+	methods  map[string]MethodHandler
+	fallback func(*Session, *Event)
+}
+
+// NewRouter 會建立一個包裝了指定處理函式的事件路由，處理函式可以是 `nil`。
+// 沒有對應處理函式的事件預設會以原始訊息交由原本處理函式的 `Message` 處理。
+func NewRouter(handler interface{}) *Router {
+	return &Router{
+		HandlerFuncs: newHandlerFuncs(handler),
+		events:       make(map[string]EventHandler),
+		methods:      make(map[string]MethodHandler),
+	}
+}
+
+// On 會註冊指定事件的處理函式，重複註冊同一個事件會覆蓋先前的處理函式。
+func (r *Router) On(event string, fn EventHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[event] = fn
+}
+
+// Fallback 會設置沒有對應處理函式的事件該交由哪個函式處理。
+func (r *Router) Fallback(fn func(*Session, *Event)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = fn
+}
+
+// Message 會將文字訊息解析成事件並交由對應的函式處理，帶有 `id` 且呼叫了以 `Handle` 註冊的方法，
+// 或是沒有事件名稱的回應則會被視為遠端呼叫或是回應，其他帶有 `id` 的事件仍會交由一般的事件處理函式處理。
+// 無法解析的訊息會以 `ErrEventMalformed` 錯誤交由處理函式的 `Error` 處理。
+func (r *Router) Message(s *Session, msg string) {
+	var ev Event
+	if err := json.Unmarshal([]byte(msg), &ev); err != nil {
+		r.Error(s, fmt.Errorf("%w: %v", ErrEventMalformed, err))
+		return
+	}
+	if ev.ID != "" && r.call(s, &ev) {
+		return
+	}
+	if ev.Event == "" {
+		r.Error(s, fmt.Errorf("%w: missing event name", ErrEventMalformed))
+		return
+	}
+	r.mu.RLock()
+	fn, ok := r.events[ev.Event]
+	fallback := r.fallback
+	r.mu.RUnlock()
+	switch {
+	case ok:
+		fn(s, ev.Data)
+	case fallback != nil:
+		fallback(s, &ev)
+	default:
+		r.HandlerFuncs.Message(s, msg)
+	}
+}
+
+// Emit 會將資料以 JSON 編碼成指定名稱的事件，並寫入到客戶端中。
+func (s *Session) Emit(event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&Event{Event: event, Data: data})
+	if err != nil {
+		return err
+	}
+	return s.Write(string(msg))
+}
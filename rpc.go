@@ -0,0 +1,206 @@
+package junipero
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// MethodHandler 是處理客戶端遠端呼叫的函式，回傳的結果會以 JSON 編碼後回應給客戶端。
+type MethodHandler func(*Session, json.RawMessage) (interface{}, error)
+
+// ClientMethodHandler 是處理伺服端遠端呼叫的函式，回傳的結果會以 JSON 編碼後回應給伺服端。
+type ClientMethodHandler func(json.RawMessage) (interface{}, error)
+
+// CallError 是遠端呼叫失敗時由對方回應的錯誤。
+type CallError struct {
+	// Message 是對方回應的錯誤訊息。
+	Message string
+}
+
+// Error 會回傳遠端呼叫的錯誤描述。
+func (e *CallError) Error() string {
+	return "junipero: remote call failed: " + e.Message
+}
+
+// pending 是等待對方回應的遠端呼叫，回應會依照關聯編號交給對應的呼叫者。
+type pending struct {
+	mu     sync.Mutex
+	lastID uint64
+	calls  map[string]chan *Event
+}
+
+// add 會登記一個新的遠端呼叫，並回傳其關聯編號與接收回應的通道。
+func (p *pending) add() (string, chan *Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.calls == nil {
+		p.calls = make(map[string]chan *Event)
+	}
+	p.lastID++
+	id := strconv.FormatUint(p.lastID, 10)
+	reply := make(chan *Event, 1)
+	p.calls[id] = reply
+	return id, reply
+}
+
+// remove 會移除指定關聯編號的遠端呼叫。
+func (p *pending) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.calls, id)
+}
+
+// resolve 會將回應交給對應的呼叫者並回傳 `true`，已經逾時或不存在的呼叫則會回傳 `false`。
+func (p *pending) resolve(ev *Event) bool {
+	p.mu.Lock()
+	reply, ok := p.calls[ev.ID]
+	delete(p.calls, ev.ID)
+	p.mu.Unlock()
+	if ok {
+		reply <- ev
+	}
+	return ok
+}
+
+// len 會回傳正在等待回應的遠端呼叫數量。
+func (p *pending) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.calls)
+}
+
+// call 會以指定的寫入函式送出遠端呼叫並等待回應，
+// 直到 `ctx` 逾時、被取消或是 `done` 被關閉為止。
+func (p *pending) call(ctx context.Context, write func(string) error, done <-chan struct{}, closed error, method string, params interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	id, reply := p.add()
+	defer p.remove(id)
+	msg, err := json.Marshal(&Event{Event: method, ID: id, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if err := write(string(msg)); err != nil {
+		return nil, err
+	}
+	select {
+	case ev := <-reply:
+		if ev.Error != "" {
+			return nil, &CallError{Message: ev.Error}
+		}
+		return ev.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+		return nil, closed
+	}
+}
+
+// reply 會執行遠端呼叫的處理函式，並以指定的寫入函式回應其結果。
+func reply(ev *Event, fn func(json.RawMessage) (interface{}, error), write func(string) error) error {
+	resp := &Event{ID: ev.ID}
+	if result, err := fn(ev.Data); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Data, err = json.Marshal(result); err != nil {
+		resp.Error = err.Error()
+	}
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return write(string(msg))
+}
+
+// Handle 會註冊能夠被客戶端以 `Client.Call` 遠端呼叫的方法，重複註冊同一個方法會覆蓋先前的處理函式。
+// 每個呼叫都會在各自的 goroutine 中執行，因此處理函式中也能夠再呼叫 `Session.Call`。
+func (r *Router) Handle(method string, fn MethodHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.methods[method] = fn
+}
+
+// call 會在事件是客戶端對已註冊方法的遠端呼叫，或是對等待中呼叫的回應時處理該事件並回傳 `true`，
+// 其他帶有 `id` 的事件則會回傳 `false` 並交由一般的事件處理函式處理。
+func (r *Router) call(s *Session, ev *Event) bool {
+	if ev.Event == "" {
+		return s.calls.resolve(ev)
+	}
+	r.mu.RLock()
+	fn, ok := r.methods[ev.Event]
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	go func() {
+		if err := reply(ev, func(data json.RawMessage) (interface{}, error) {
+			return fn(s, data)
+		}, s.Write); err != nil {
+			r.Error(s, err)
+		}
+	}()
+	return true
+}
+
+// Call 會呼叫客戶端以 `Client.Handle` 註冊的方法並等待其回應，直到 `ctx` 逾時或被取消為止。
+// 階段關閉時所有等待中的呼叫都會回傳 `ErrSessionClosed`，對方回應的錯誤則會是 `*CallError`。
+// 客戶端的回應需要經由 `Router` 處理，因此引擎沒有使用 `Router` 作為處理函式時會直接回傳 `ErrRouterRequired`。
+func (s *Session) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if !s.engine.routed {
+		return nil, ErrRouterRequired
+	}
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+	return s.calls.call(ctx, s.Write, s.done, ErrSessionClosed, method, params)
+}
+
+// Handle 會註冊能夠被伺服端以 `Session.Call` 遠端呼叫的方法，重複註冊同一個方法會覆蓋先前的處理函式。
+// 遠端呼叫會在讀取訊息時被處理，因此必須持續地呼叫 `Read` 或 `ReadAll`，呼叫未註冊的方法則會被當作一般訊息讀取。
+func (c *Client) Handle(method string, fn ClientMethodHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.methods == nil {
+		c.methods = make(map[string]ClientMethodHandler)
+	}
+	c.methods[method] = fn
+}
+
+// Call 會呼叫伺服端以 `Router.Handle` 註冊的方法並等待其回應，直到 `ctx` 逾時或被取消為止。
+// 回應會在讀取訊息時被處理，因此必須有另一個 goroutine 持續地呼叫 `Read` 或 `ReadAll`。
+// 伺服端不會回應未註冊的方法，因此建議以 `ctx` 設置逾時。
+func (c *Client) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if c.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	return c.calls.call(ctx, c.Write, c.done, ErrConnectionClosed, method, params)
+}
+
+// call 會在訊息是對已註冊方法的遠端呼叫，或是對等待中呼叫的回應時處理該訊息並回傳 `true`，
+// 其他的訊息則會回傳 `false` 並交由 `Read` 讀取。
+func (c *Client) call(msg []byte) bool {
+	c.mu.RLock()
+	enabled := len(c.methods) != 0
+	c.mu.RUnlock()
+	if !enabled && c.calls.len() == 0 {
+		return false
+	}
+	var ev Event
+	if err := json.Unmarshal(msg, &ev); err != nil || ev.ID == "" {
+		return false
+	}
+	if ev.Event == "" {
+		return c.calls.resolve(&ev)
+	}
+	c.mu.RLock()
+	fn, ok := c.methods[ev.Event]
+	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	go reply(&ev, fn, c.Write)
+	return true
+}
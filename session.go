@@ -1,44 +1,349 @@
 package junipero
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Session 是單個客戶端階段。
+// Session 是單個客戶端階段，可以安全地被多個 goroutine 同時使用。
 type Session struct {
-	// id 是此階段的獨立號碼。
-	id int
+	// dropped 是因寫入佇列已滿而被拋棄的訊息數量，
+	// 為了在 32 位元平台上能夠以 atomic 存取，這必須是第一個欄位。
+	dropped uint64
+	// id 是此階段的獨立編號，由引擎設置的 `IDGenerator` 產生。
+	id string
+	// handshake 是客戶端升級成 WebSocket 連線時的 HTTP 請求快照。
+	handshake *Handshake
+	// ctx 是此階段的上下文，會在階段結束時被取消。
+	ctx context.Context
+	// cancel 會以指定的原因取消此階段的上下文。
+	cancel context.CancelCauseFunc
+	// conn 是該階段的 WebSocket 連線，只有寫入迴圈會寫入訊息至此連線。
+	conn *websocket.Conn
+	// send 是等待寫入迴圈傳送至客戶端的訊息佇列。
+	send chan *message
+	// done 會在階段關閉時被關閉，用以通知寫入迴圈結束。
+	done chan struct{}
+	// closeMsg 是寫入迴圈在送出佇列中剩餘訊息後，最後要傳送的關閉訊息。
+	closeMsg []byte
+	// readDone 會在讀取迴圈結束時被關閉，寫入迴圈會藉此等待客戶端回應關閉訊息。
+	readDone chan struct{}
+	// codec 是此階段依照協商後的子協定所選擇的編碼方式。
+	codec Codec
+
+	// mu 保護了下列的存儲、訂閱、狀態與使用者欄位。
+	mu sync.RWMutex
 	// store 是階段存儲資料。
 	store map[string]interface{}
-	// Subscriptions 是此階段訂閱的所有頻道。
-	Subscriptions map[string]*Channel
+	// subscriptions 是此階段訂閱的所有頻道。
+	subscriptions map[string]*Channel
 	// isClosed 表示此階段是否已經關閉了。
 	isClosed bool
-	// conn 是該階段的 WebSocket 連線。
-	conn *websocket.Conn
+	// userID 是此階段綁定的使用者編號。
+	userID string
+
+	// calls 是等待客戶端回應的遠端呼叫。
+	calls pending
 
 	// engine 是此階段所屬的引擎。
 	engine *Engine
 }
 
-// NewSession 會在引擎中建立一個新的客戶端階段。
+// message 是一則等待被寫入至客戶端的訊息。
+type message struct {
+	typ  MessageType
+	data []byte
+	// prepared 是預先編碼好的訊框，廣播時會由所有客戶端共用以避免重複編碼與壓縮。
+	prepared *websocket.PreparedMessage
+}
+
+// newPreparedMessage 會建立一則帶有預先編碼訊框的訊息，無法預先編碼時則會在寫入時個別編碼。
+func newPreparedMessage(typ MessageType, data []byte) *message {
+	m := &message{typ: typ, data: data}
+	if pm, err := websocket.NewPreparedMessage(int(typ), data); err == nil {
+		m.prepared = pm
+	}
+	return m
+}
+
+// cloneBytes 會複製呼叫者傳入的二進制訊息，由於訊息是非同步地被寫入，
+// 呼叫者在函式回傳後可能會重新使用原本的切片。
+func cloneBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// NewSession 會在引擎中建立一個新的客戶端階段，並且開始該階段的寫入迴圈。
 func (e *Engine) NewSession(conn *websocket.Conn) *Session {
-	e.lastID++
+	return e.newSession(context.Background(), conn, nil, nil)
+}
+
+// maxIDAttempts 是產生不重複的階段編號時最多能夠嘗試的次數。
+const maxIDAttempts = 100
+
+// newSession 會建立一個衍生自 `ctx` 並帶有握手快照與預先存儲資料的客戶端階段，
+// 這些資料會在階段能被其他 goroutine 存取之前就設置完畢。
+func (e *Engine) newSession(ctx context.Context, conn *websocket.Conn, h *Handshake, store map[string]interface{}) *Session {
+	ctx, cancel := context.WithCancelCause(ctx)
 	s := &Session{
-		id:            e.lastID,
-		store:         make(map[string]interface{}),
-		Subscriptions: make(map[string]*Channel),
+		ctx:           ctx,
+		cancel:        cancel,
+		store:         make(map[string]interface{}, len(store)),
+		subscriptions: make(map[string]*Channel),
+		handshake:     h,
 		conn:          conn,
+		send:          make(chan *message, e.config.SendQueueSize),
+		done:          make(chan struct{}),
+		readDone:      make(chan struct{}),
 		engine:        e,
 	}
-	e.sessions[e.lastID] = s
+	if conn != nil {
+		s.codec = selectCodec(conn.Subprotocol(), e.config.Codecs, e.config.Codec)
+	} else {
+		s.codec = selectCodec("", nil, e.config.Codec)
+	}
+	for k, v := range store {
+		s.store[k] = v
+	}
+	// 編號重複時會重新產生，以免自訂的編號產生函式覆蓋了既有的階段，
+	// 持續重複則表示編號產生函式有問題，此時會中斷連線並引發 panic 而不是無止盡地重試。
+	for i := 0; ; i++ {
+		if i == maxIDAttempts {
+			cancel(nil)
+			if conn != nil {
+				conn.Close()
+			}
+			panic(fmt.Sprintf("junipero: IDGenerator returned %d duplicate session IDs in a row", maxIDAttempts))
+		}
+		s.id = e.config.IDGenerator()
+		if e.sessions.store(s) {
+			break
+		}
+	}
+	s.mu.Lock()
+	for k, v := range s.store {
+		e.index.add(s, k, v)
+	}
+	s.mu.Unlock()
+	if conn != nil {
+		e.wg.Add(1)
+		go s.writePump()
+	}
 	return s
 }
 
+// writePump 是階段的寫入迴圈，這是唯一會將訊息寫入連線的 goroutine，
+// 並且會依照 `PingPeriod` 定期向客戶端發送 Ping。
+// 當階段關閉時，會先將佇列中剩餘的訊息寫出並傳送關閉訊息後才關閉連線。
+func (s *Session) writePump() {
+	defer s.engine.wg.Done()
+	defer s.conn.Close()
+	var ping <-chan time.Time
+	if s.engine.config.PingPeriod > 0 {
+		ticker := time.NewTicker(s.engine.config.PingPeriod)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-ping:
+			if err := s.Ping(); err != nil {
+				s.engine.handler.Error(s, err)
+				s.close(nil, err)
+				return
+			}
+		case m := <-s.send:
+			if err := s.writeMessage(m); err != nil {
+				s.close(nil, err)
+				return
+			}
+		case <-s.done:
+			for {
+				select {
+				case m := <-s.send:
+					if err := s.writeMessage(m); err != nil {
+						return
+					}
+				default:
+					if s.closeMsg != nil {
+						s.closeHandshake()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeDeadline 會依照 `WriteWait` 回傳寫入期限，`WriteWait` 為 `0` 時則不會有期限。
+func (s *Session) writeDeadline() time.Time {
+	if s.engine.config.WriteWait <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.engine.config.WriteWait)
+}
+
+// writeMessage 會將單則訊息寫入連線，並在成功後呼叫對應的處理函式。
+func (s *Session) writeMessage(m *message) error {
+	s.conn.SetWriteDeadline(s.writeDeadline())
+	var err error
+	if m.prepared != nil {
+		err = s.conn.WritePreparedMessage(m.prepared)
+	} else {
+		err = s.conn.WriteMessage(int(m.typ), m.data)
+	}
+	if err != nil {
+		s.engine.handler.Error(s, err)
+		return err
+	}
+	// 只有在設置了處理函式時才轉換訊息，以免廣播時每個客戶端都得複製一次訊息。
+	switch {
+	case m.typ == TextMessage && s.engine.handler.OnSentMessage != nil:
+		s.engine.handler.SentMessage(s, string(m.data))
+	case m.typ == BinaryMessage && s.engine.handler.OnSentMessageBinary != nil:
+		s.engine.handler.SentMessageBinary(s, m.data)
+	}
+	return nil
+}
+
+// enqueue 會依照引擎的溢出策略將訊息放入寫入佇列。
+func (s *Session) enqueue(m *message) error {
+	return s.enqueueWith(m, s.engine.config.OverflowPolicy, s.engine.config.OverflowTimeout)
+}
+
+// enqueueWith 會將訊息放入寫入佇列，當佇列已滿時則依照指定的溢出策略處理。
+func (s *Session) enqueueWith(m *message, policy OverflowPolicy, timeout time.Duration) error {
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+	select {
+	case s.send <- m:
+		return nil
+	default:
+	}
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-s.send:
+				s.drop()
+			default:
+			}
+			select {
+			case s.send <- m:
+				return nil
+			case <-s.done:
+				return ErrSessionClosed
+			default:
+			}
+		}
+	case OverflowBlock:
+		if timeout == 0 {
+			timeout = s.engine.config.WriteWait
+		}
+		// 沒有設置等待時間時會一直等到佇列有空間或是階段關閉為止。
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case s.send <- m:
+			return nil
+		case <-s.done:
+			return ErrSessionClosed
+		case <-expired:
+			s.drop()
+			return ErrWriteTimedOut
+		}
+	case OverflowDisconnect:
+		s.drop()
+		s.discard()
+		s.CloseWithStatus(ClosePolicyViolation, "send queue overflow")
+		return ErrSendQueueFull
+	default:
+		s.drop()
+		return ErrSendQueueFull
+	}
+}
+
+// drop 會記錄一則因寫入佇列已滿而被拋棄的訊息。
+func (s *Session) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+	atomic.AddUint64(&s.engine.dropped, 1)
+}
+
+// discard 會拋棄寫入佇列中所有尚未送出的訊息。
+func (s *Session) discard() {
+	for {
+		select {
+		case <-s.send:
+			s.drop()
+		default:
+			return
+		}
+	}
+}
+
+// Dropped 會回傳此階段因寫入佇列已滿而被拋棄的訊息數量。
+func (s *Session) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// closeHandshake 會傳送關閉訊息給客戶端，並在 `CloseTimeout` 內等待客戶端回應關閉訊息。
+func (s *Session) closeHandshake() {
+	err := s.conn.WriteControl(int(CloseMessage), s.closeMsg, s.writeDeadline())
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(s.engine.config.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.readDone:
+	case <-timer.C:
+	}
+}
+
+// ID 會回傳此階段的獨立編號。
+func (s *Session) ID() string {
+	return s.id
+}
+
+// RandomID 會以 128 位元的隨機數產生一個能夠用於網址的字串編號，這是引擎預設的編號產生函式。
+func RandomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Handshake 會回傳客戶端升級成 WebSocket 連線時的 HTTP 請求快照，
+// 這能用來取得客戶端的網路位置、標頭、Cookie、查詢參數與 TLS 狀態。
+// 不是經由引擎升級而來的階段會回傳 `nil`。
+func (s *Session) Handshake() *Handshake {
+	return s.handshake
+}
+
+// Context 會回傳此階段的上下文，這衍生自客戶端的升級請求，並會在階段結束時被取消。
+// 取消原因可以透過 `context.Cause` 取得：以關閉訊息結束時為 `*CloseError`，連線中斷時則為讀取或寫入的錯誤。
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
 // Get 能夠從客戶端階段中取得暫存資料。
 func (s *Session) Get(k string) (v interface{}, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	v, ok = s.store[k]
 	return
 }
@@ -142,13 +447,53 @@ func (s *Session) GetTime(k string) time.Time {
 	return v.(time.Time)
 }
 
-// Close 會良好地結束與此客戶端的連線。
+// Close 會以 `CloseNormalClosure` 良好地結束與此客戶端的連線，
+// 在關閉之前已經寫入的訊息仍會被送出，但此函式並不會等待其完成。
+//
+// 不論連線是如何結束的，階段都會經由此函式從引擎與所有頻道中移除，
+// 並且僅會呼叫一次 `Disconnect` 處理函式。
 func (s *Session) Close() error {
+	return s.CloseWithStatus(CloseNormalClosure, "")
+}
+
+// CloseWithStatus 會以指定的狀態代號與原因結束與此客戶端的連線。
+// 在佇列中剩餘的訊息送出後會傳送關閉訊息給客戶端，並在 `CloseTimeout` 內等待客戶端回應以完成關閉交握，
+// 如此一來客戶端便能夠得知連線被關閉的原因（如：`ClosePolicyViolation` 或 `CloseServiceRestart`）。
+func (s *Session) CloseWithStatus(status CloseStatus, reason string) error {
+	return s.close(websocket.FormatCloseMessage(int(status), reason), &CloseError{Status: status, Reason: reason})
+}
+
+// close 會關閉此階段，如果有指定關閉訊息則會在佇列中剩餘的訊息送出後傳送給客戶端，
+// 而 `cause` 則會作為此階段 `Context` 的取消原因。
+func (s *Session) close(closeMsg []byte, cause error) error {
+	s.mu.Lock()
 	if s.isClosed {
+		s.mu.Unlock()
 		return ErrSessionClosed
 	}
 	s.isClosed = true
-	return s.conn.Close()
+	s.closeMsg = closeMsg
+	close(s.done)
+	s.mu.Unlock()
+	s.teardown(cause)
+	return nil
+}
+
+// teardown 會將已關閉的階段從引擎、存儲資料索引、綁定的使用者與所有訂閱的頻道中移除，
+// 以指定的原因取消階段的 `Context`，並呼叫 `Disconnect` 處理函式。
+func (s *Session) teardown(cause error) {
+	s.cancel(cause)
+	s.engine.sessions.delete(s.id)
+	s.mu.Lock()
+	for k, v := range s.store {
+		s.engine.index.remove(s, k, v)
+	}
+	if s.userID != "" {
+		s.engine.users.remove(s, s.userID)
+	}
+	s.mu.Unlock()
+	s.UnsubscribeAll()
+	s.engine.handler.Disconnect(s)
 }
 
 // CloseWithMsg 會關閉與此客戶端的連線，並在那之前傳送最後一則文字訊息。
@@ -179,92 +524,175 @@ func (s *Session) CloseWithBinary(msg []byte) error {
 
 // IsClosed 會表示此客戶端階段是否已經關閉連線了。
 func (s *Session) IsClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.isClosed
 }
 
 // Set 能夠將指定的資料存儲到此客戶端階段中作為暫存快取。
 func (s *Session) Set(k string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.store[k]; ok {
+		s.engine.index.remove(s, k, old)
+	}
 	s.store[k] = v
+	// 已經關閉的階段已從索引中移除，不應該再被加入。
+	if !s.isClosed {
+		s.engine.index.add(s, k, v)
+	}
 }
 
 // Delete 會將指定資料從暫存快取中移除。
 func (s *Session) Delete(k string) error {
-	_, ok := s.store[k]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.store[k]
 	if !ok {
 		return ErrKeyNotFound
 	}
+	s.engine.index.remove(s, k, v)
 	delete(s.store, k)
 	return nil
 }
 
-// Write 能透將文字訊息寫入到客戶端中。
+// Write 能透將文字訊息放入寫入佇列，並由寫入迴圈非同步地傳送到客戶端中。
 func (s *Session) Write(msg string) error {
-	err := s.conn.WriteMessage(int(TextMessage), []byte(msg))
-	if err == nil {
-		s.engine.handler.SentMessage(s, msg)
-	}
-	return err
+	return s.enqueue(&message{typ: TextMessage, data: []byte(msg)})
 }
 
-// WriteBinary 能透將二進制訊息寫入到客戶端中。
+// WriteBinary 能透將二進制訊息放入寫入佇列，並由寫入迴圈非同步地傳送到客戶端中。
+// 訊息會先被複製，因此呼叫者在回傳後可以繼續使用 `msg`。
 func (s *Session) WriteBinary(msg []byte) error {
-	err := s.conn.WriteMessage(int(BinaryMessage), []byte(msg))
-	if err == nil {
-		s.engine.handler.SentMessageBinary(s, msg)
-	}
-	return err
+	return s.enqueue(&message{typ: BinaryMessage, data: cloneBytes(msg)})
 }
 
 // Pong 能夠自主地回應客戶端一個 Pong 訊息，表示伺服器仍然有回應。
 func (s *Session) Pong() error {
-	return s.conn.WriteControl(int(PongMessage), []byte(``), time.Now().Add(s.engine.config.WriteWait))
+	return s.conn.WriteControl(int(PongMessage), []byte(``), s.writeDeadline())
 }
 
 // Ping 能夠詢問此客戶端的連線反應狀況，
 // 如果在指定時間內沒有接收到 Pong 回應則會關閉並結束此連線。
 func (s *Session) Ping() error {
-	return s.conn.WriteControl(int(PingMessage), []byte(``), time.Now().Add(s.engine.config.WriteWait))
+	return s.conn.WriteControl(int(PingMessage), []byte(``), s.writeDeadline())
 }
 
-// Subscribe 會訂閱一個頻道。
+// channel 會從引擎中取得指定名稱的頻道。
+func (s *Session) channel(ch string) (*Channel, bool) {
+	return s.engine.Channel(ch)
+}
+
+// extendReadDeadline 會依照 `PongWait` 延長連線的讀取期限，
+// 客戶端在期限內沒有任何 Ping、Pong 響應則會被視為逾時。
+func (s *Session) extendReadDeadline() {
+	if s.engine.config.PongWait > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.engine.config.PongWait))
+	}
+}
+
+// Subscribe 會訂閱一個頻道，頻道的訂閱者已達上限時會回傳 `ErrChannelFull`。
 func (s *Session) Subscribe(ch string) error {
-	v, ok := s.engine.channels[ch]
+	v, ok := s.channel(ch)
 	if !ok {
 		return ErrChannelNotFound
 	}
-	_, ok = v.Sessions[s.id]
-	if ok {
+	if err := s.subscribe(v); err != nil {
+		return err
+	}
+	if v.config != nil && v.config.OnSubscribe != nil {
+		v.config.OnSubscribe(v, s)
+	}
+	return nil
+}
+
+// subscribe 會將此階段加入至指定的頻道。
+func (s *Session) subscribe(v *Channel) error {
+	// 訂閱時只會讀取鎖定頻道以確保頻道不會同時被關閉，不同分片的訂閱者能夠同時訂閱。
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.isClosed {
+		return ErrChannelClosed
+	}
+	sh := v.sessions.shard(s.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.sessions[s.id]; ok {
 		return ErrChannelSubscribed
 	}
-	v.Sessions[s.id] = s
-	s.Subscriptions[ch] = v
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return ErrSessionClosed
+	}
+	if !v.reserve() {
+		return ErrChannelFull
+	}
+	if sh.sessions == nil {
+		sh.sessions = make(map[string]*Session)
+	}
+	sh.sessions[s.id] = s
+	s.subscriptions[v.name] = v
 	return nil
 }
 
 // Unsubscribe 會取消訂閱一個頻道。
 func (s *Session) Unsubscribe(ch string) error {
-	v, ok := s.engine.channels[ch]
+	v, ok := s.channel(ch)
 	if !ok {
 		return ErrChannelNotFound
 	}
-	_, ok = v.Sessions[s.id]
-	if !ok {
+	return s.unsubscribe(v)
+}
+
+// unsubscribe 會將此階段從指定的頻道中移除，並在解除鎖定後呼叫 `OnUnsubscribe`。
+func (s *Session) unsubscribe(v *Channel) error {
+	sh := v.sessions.shard(s.id)
+	sh.mu.Lock()
+	if _, ok := sh.sessions[s.id]; !ok {
+		sh.mu.Unlock()
 		return ErrChannelNotSubscribed
 	}
-	delete(v.Sessions, s.id)
-	delete(s.Subscriptions, ch)
+	delete(sh.sessions, s.id)
+	s.mu.Lock()
+	// 頻道關閉後同名的新頻道可能已經被訂閱了，此時不能移除新頻道的訂閱。
+	if s.subscriptions[v.name] == v {
+		delete(s.subscriptions, v.name)
+	}
+	s.mu.Unlock()
+	n := atomic.AddInt64(&v.subscribers, -1)
+	sh.mu.Unlock()
+	if v.config != nil && v.config.OnUnsubscribe != nil {
+		v.config.OnUnsubscribe(v, s)
+	}
+	if n == 0 {
+		v.empty()
+	}
 	return nil
 }
 
 // UnsubscribeAll 會取消訂閱此客戶端所有訂閱的頻道。
 func (s *Session) UnsubscribeAll() {
-	for k := range s.Subscriptions {
-		s.Unsubscribe(k)
+	for _, v := range s.Subscriptions() {
+		s.unsubscribe(v)
+	}
+}
+
+// Subscriptions 會回傳一份此客戶端目前訂閱的所有頻道複本。
+func (s *Session) Subscriptions() map[string]*Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subscriptions := make(map[string]*Channel, len(s.subscriptions))
+	for k, v := range s.subscriptions {
+		subscriptions[k] = v
 	}
+	return subscriptions
 }
 
 // IsSubscribed 會表示客戶端是否有訂閱指定的頻道。
 func (s *Session) IsSubscribed(ch string) bool {
-	_, ok := s.Subscriptions[ch]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.subscriptions[ch]
 	return ok
 }
@@ -0,0 +1,104 @@
+package junipero
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount 是階段集合的分片數量，必須是 2 的次方。
+const shardCount = 32
+
+// sessionMap 是以階段編號雜湊分片的階段集合，不同分片的存取不會互相阻塞，
+// 用以避免大量客戶端同時連線、中斷或訂閱時都在等待同一個鎖。
+type sessionMap struct {
+	shards [shardCount]sessionShard
+}
+
+// sessionShard 是階段集合中的單個分片。
+type sessionShard struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// shard 會回傳指定階段編號所屬的分片，分片是依照編號的 FNV-1a 雜湊值而定。
+func (m *sessionMap) shard(id string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &m.shards[h.Sum32()&(shardCount-1)]
+}
+
+// store 會將階段放入集合中，如果該階段早已存在則回傳 `false`。
+func (m *sessionMap) store(s *Session) bool {
+	sh := m.shard(s.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.sessions[s.id]; ok {
+		return false
+	}
+	if sh.sessions == nil {
+		sh.sessions = make(map[string]*Session)
+	}
+	sh.sessions[s.id] = s
+	return true
+}
+
+// delete 會將指定編號的階段從集合中移除，如果該階段不存在則回傳 `false`。
+func (m *sessionMap) delete(id string) bool {
+	sh := m.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.sessions[id]; !ok {
+		return false
+	}
+	delete(sh.sessions, id)
+	return true
+}
+
+// load 會取得指定編號的階段。
+func (m *sessionMap) load(id string) (*Session, bool) {
+	sh := m.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	s, ok := sh.sessions[id]
+	return s, ok
+}
+
+// len 會回傳集合中的階段數量。
+func (m *sessionMap) len() int {
+	var n int
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		n += len(sh.sessions)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// snapshot 會逐一鎖定每個分片並複製一份目前所有的階段。
+func (m *sessionMap) snapshot() []*Session {
+	sessions := make([]*Session, 0, m.len())
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for _, v := range sh.sessions {
+			sessions = append(sessions, v)
+		}
+		sh.mu.RUnlock()
+	}
+	return sessions
+}
+
+// copy 會回傳一份以階段編號對應的目前所有階段複本。
+func (m *sessionMap) copy() map[string]*Session {
+	sessions := make(map[string]*Session, m.len())
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for k, v := range sh.sessions {
+			sessions[k] = v
+		}
+		sh.mu.RUnlock()
+	}
+	return sessions
+}
@@ -1,6 +1,9 @@
 package junipero
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 //
 type MessageType int
@@ -27,6 +30,22 @@ const (
 	PongMessage MessageType = 10
 )
 
+// OverflowPolicy 是階段寫入佇列已滿時的處理方式。
+type OverflowPolicy int
+
+const (
+	// OverflowDefault 會沿用上層的設置，在引擎中則等同於 `OverflowDropNewest`。
+	OverflowDefault OverflowPolicy = iota
+	// OverflowDropNewest 會拋棄新寫入的訊息並回傳 `ErrSendQueueFull`。
+	OverflowDropNewest
+	// OverflowDropOldest 會拋棄佇列中最舊的訊息來騰出空間給新的訊息。
+	OverflowDropOldest
+	// OverflowBlock 會阻塞寫入直到佇列有空間為止，逾時則拋棄訊息並回傳 `ErrWriteTimedOut`。
+	OverflowBlock
+	// OverflowDisconnect 會拋棄佇列中所有訊息並以 `ClosePolicyViolation` 中斷該客戶端的連線。
+	OverflowDisconnect
+)
+
 // CloseStatus 是連線被關閉時的狀態代號。
 type CloseStatus int
 
@@ -54,8 +73,28 @@ var (
 	ErrConnectionClosed     = errors.New("junipero: interacting with a disconnected connection")
 	ErrSessionClosed        = errors.New("junipero: interacting with a closed session")
 	ErrChannelNotFound      = errors.New("junipero: interacting with a undefined channel")
+	ErrChannelExists        = errors.New("junipero: creating a channel with a duplicate name")
+	ErrChannelFull          = errors.New("junipero: subscribing to a full channel")
 	ErrChannelSubscribed    = errors.New("junipero: subscribing to a subscribed channel")
 	ErrChannelNotSubscribed = errors.New("junipero: unsubscribing a unsubscribed channel")
 	ErrKeyNotFound          = errors.New("junipero: accessing a undefined key from the session store")
 	ErrWriteTimedOut        = errors.New("junipero: write timed out")
+	ErrSendQueueFull        = errors.New("junipero: writing to a session with a full send queue")
+	ErrEventMalformed       = errors.New("junipero: receiving a malformed event")
+	ErrMethodNotFound       = errors.New("junipero: calling a undefined method")
+	ErrUserSessionsExceeded = errors.New("junipero: binding a session to a user with too many sessions")
+	ErrRouterRequired       = errors.New("junipero: calling a client without a router handler")
 )
+
+// CloseError 是階段以關閉訊息結束時，作為其 `Context` 取消原因的錯誤。
+type CloseError struct {
+	// Status 是關閉訊息的狀態代號。
+	Status CloseStatus
+	// Reason 是關閉訊息的原因。
+	Reason string
+}
+
+// Error 會回傳關閉訊息的錯誤描述。
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("junipero: session closed with status %d: %s", e.Status, e.Reason)
+}
@@ -0,0 +1,102 @@
+package junipero
+
+import "sync"
+
+// userMap 是以使用者編號對應其所有階段的集合，一個使用者可以同時有多個裝置或分頁連線。
+type userMap struct {
+	mu    sync.RWMutex
+	users map[string]map[string]*Session
+}
+
+// add 會將階段綁定至指定的使用者，超過每個使用者的連線數量上限時則會回傳 `ErrUserSessionsExceeded`。
+func (m *userMap) add(s *Session, userID string, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions, ok := m.users[userID]
+	if !ok {
+		if m.users == nil {
+			m.users = make(map[string]map[string]*Session)
+		}
+		sessions = make(map[string]*Session)
+		m.users[userID] = sessions
+	}
+	if limit > 0 && len(sessions) >= limit {
+		return ErrUserSessionsExceeded
+	}
+	sessions[s.id] = s
+	return nil
+}
+
+// remove 會將階段與指定的使用者解除綁定。
+func (m *userMap) remove(s *Session, userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := m.users[userID]
+	delete(sessions, s.id)
+	if len(sessions) == 0 {
+		delete(m.users, userID)
+	}
+}
+
+// sessions 會回傳一份指定使用者目前所有的階段。
+func (m *userMap) sessions(userID string) []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := make([]*Session, 0, len(m.users[userID]))
+	for _, v := range m.users[userID] {
+		sessions = append(sessions, v)
+	}
+	return sessions
+}
+
+// Bind 會將此階段綁定至指定的使用者，階段結束時會自動解除綁定。已經綁定其他使用者的階段會改為綁定至新的使用者，
+// 傳入空字串則會解除綁定。使用者的連線數量達到 `MaxSessionsPerUser` 時會回傳 `ErrUserSessionsExceeded` 並維持原本的綁定。
+func (s *Session) Bind(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return ErrSessionClosed
+	}
+	if s.userID == userID {
+		return nil
+	}
+	if userID != "" {
+		if err := s.engine.users.add(s, userID, s.engine.config.MaxSessionsPerUser); err != nil {
+			return err
+		}
+	}
+	if s.userID != "" {
+		s.engine.users.remove(s, s.userID)
+	}
+	s.userID = userID
+	return nil
+}
+
+// UserID 會回傳此階段綁定的使用者編號，沒有綁定時則會回傳空字串。
+func (s *Session) UserID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.userID
+}
+
+// UserSessions 會回傳指定使用者目前所有連線中的客戶端階段。
+func (e *Engine) UserSessions(userID string) []*Session {
+	return e.users.sessions(userID)
+}
+
+// SendToUser 會將文字訊息傳送到指定使用者的所有客戶端。
+func (e *Engine) SendToUser(userID string, msg string) *BroadcastReport {
+	return e.fanOut(e.users.sessions(userID), newPreparedMessage(TextMessage, []byte(msg)), (*Session).enqueue)
+}
+
+// SendBinaryToUser 會將二進制訊息傳送到指定使用者的所有客戶端。
+func (e *Engine) SendBinaryToUser(userID string, msg []byte) *BroadcastReport {
+	return e.fanOut(e.users.sessions(userID), newPreparedMessage(BinaryMessage, cloneBytes(msg)), (*Session).enqueue)
+}
+
+// DisconnectUser 會以指定的狀態代號與原因中斷指定使用者的所有客戶端連線。
+func (e *Engine) DisconnectUser(userID string, status CloseStatus, reason string) {
+	for _, v := range e.users.sessions(userID) {
+		v.CloseWithStatus(status, reason)
+	}
+}